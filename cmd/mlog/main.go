@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -12,7 +15,17 @@ import (
 
 	"github.com/SdxShadow/Mlog/internal/config"
 	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/internal/detector"
+	"github.com/SdxShadow/Mlog/internal/errorgroup"
+	"github.com/SdxShadow/Mlog/internal/latency"
 	"github.com/SdxShadow/Mlog/internal/monitor"
+	"github.com/SdxShadow/Mlog/internal/parser"
+	"github.com/SdxShadow/Mlog/internal/parser/application"
+	"github.com/SdxShadow/Mlog/internal/parser/custom"
+	"github.com/SdxShadow/Mlog/internal/parser/multiline"
+	"github.com/SdxShadow/Mlog/internal/parser/systemd"
+	"github.com/SdxShadow/Mlog/internal/parser/timestamp"
+	"github.com/SdxShadow/Mlog/internal/session"
 	"github.com/SdxShadow/Mlog/pkg/types"
 	"github.com/spf13/cobra"
 )
@@ -44,6 +57,70 @@ var queryCmd = &cobra.Command{
 	Run:   runQuery,
 }
 
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "List SSH sessions",
+	Run:   runSessions,
+}
+
+var accountsCmd = &cobra.Command{
+	Use:   "accounts",
+	Short: "Show account change history per user",
+	Run:   runAccounts,
+}
+
+var servicesCmd = &cobra.Command{
+	Use:   "services",
+	Short: "Show systemd units that crash or restart, with the HTTP 5xx around them",
+	Run:   runServices,
+}
+
+var errorsCmd = &cobra.Command{
+	Use:   "errors",
+	Short: "Show recurring nginx, Apache and PM2 errors grouped by fingerprint",
+	Run:   runErrors,
+}
+
+var httpCmd = &cobra.Command{
+	Use:   "http",
+	Short: "HTTP request analytics from the access logs",
+}
+
+var httpLatencyCmd = &cobra.Command{
+	Use:   "latency",
+	Short: "Show p50/p90/p99 response times per vhost and per route",
+	Run:   runHTTPLatency,
+}
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Database administration",
+}
+
+var dbMaintenanceCmd = &cobra.Command{
+	Use:   "maintenance",
+	Short: "Show what retention and size enforcement have pruned",
+	Run:   runDBMaintenance,
+}
+
+var dbMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply pending schema migrations",
+	Run:   runDBMigrate,
+}
+
+var dbStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the schema version and pending migrations",
+	Run:   runDBStatus,
+}
+
+var pipelineCmd = &cobra.Command{
+	Use:   "pipeline",
+	Short: "Show ingestion queue and batch writer metrics",
+	Run:   runPipeline,
+}
+
 var stopCmd = &cobra.Command{
 	Use:   "stop",
 	Short: "Stop the running mlog daemon",
@@ -54,13 +131,55 @@ func main() {
 	rootCmd.AddCommand(serveCmd)
 	rootCmd.AddCommand(dashboardCmd)
 	rootCmd.AddCommand(queryCmd)
+	rootCmd.AddCommand(sessionsCmd)
+	rootCmd.AddCommand(accountsCmd)
+	rootCmd.AddCommand(servicesCmd)
+	rootCmd.AddCommand(errorsCmd)
+	rootCmd.AddCommand(httpCmd)
+	rootCmd.AddCommand(dbCmd)
+	rootCmd.AddCommand(pipelineCmd)
 	rootCmd.AddCommand(stopCmd)
+	httpCmd.AddCommand(httpLatencyCmd)
+	dbCmd.AddCommand(dbMaintenanceCmd)
+	dbCmd.AddCommand(dbMigrateCmd)
+	dbCmd.AddCommand(dbStatusCmd)
 
 	serveCmd.Flags().StringP("config", "c", "/etc/mlog/mlog.yaml", "Config file path")
 	dashboardCmd.Flags().StringP("config", "c", "/etc/mlog/mlog.yaml", "Config file path")
 	queryCmd.Flags().StringP("type", "t", "", "Event type filter")
 	queryCmd.Flags().StringP("ip", "i", "", "Source IP filter")
 	queryCmd.Flags().Int("limit", 50, "Result limit")
+	sessionsCmd.Flags().StringP("config", "c", "/etc/mlog/mlog.yaml", "Config file path")
+	sessionsCmd.Flags().StringP("user", "u", "", "Username filter")
+	sessionsCmd.Flags().StringP("ip", "i", "", "Source IP filter")
+	sessionsCmd.Flags().String("since", "", "Sessions active after this time (e.g. 2h, 02:00, 2024-01-02 02:00)")
+	sessionsCmd.Flags().String("until", "", "Sessions active before this time")
+	sessionsCmd.Flags().Int("limit", 50, "Result limit")
+	accountsCmd.Flags().StringP("config", "c", "/etc/mlog/mlog.yaml", "Config file path")
+	accountsCmd.Flags().StringP("user", "u", "", "Username filter")
+	accountsCmd.Flags().String("since", "", "Only changes after this time (e.g. 30d, 2024-01-02)")
+	accountsCmd.Flags().Int("limit", 500, "Result limit")
+	servicesCmd.Flags().StringP("config", "c", "/etc/mlog/mlog.yaml", "Config file path")
+	servicesCmd.Flags().StringP("unit", "u", "", "Only this unit (e.g. nginx.service)")
+	servicesCmd.Flags().String("since", "24h", "Only events after this time (e.g. 2h, 7d, 2024-01-02)")
+	servicesCmd.Flags().Int("threshold", 3, "Failures or restarts that make a unit flapping")
+	servicesCmd.Flags().Bool("all", false, "List every unit seen, not only flapping ones")
+	servicesCmd.Flags().Duration("window", 2*time.Minute, "Count HTTP 5xx responses this long after each crash")
+	errorsCmd.Flags().StringP("config", "c", "/etc/mlog/mlog.yaml", "Config file path")
+	errorsCmd.Flags().StringP("type", "t", "", "Only nginx, apache or pm2 errors")
+	errorsCmd.Flags().String("since", "7d", "Only groups seen after this time (e.g. 24h, 30d, 2024-01-02)")
+	errorsCmd.Flags().String("sort", "score", "Order by score (count, decaying by half each day since last seen), count, recent or new")
+	errorsCmd.Flags().Int("limit", 20, "Number of groups to show")
+	errorsCmd.Flags().BoolP("verbose", "v", false, "Show the latest sample of each group")
+	httpCmd.PersistentFlags().StringP("config", "c", "/etc/mlog/mlog.yaml", "Config file path")
+	httpLatencyCmd.Flags().String("since", "1h", "Window to compute the percentiles over (e.g. 5m, 24h, 7d)")
+	httpLatencyCmd.Flags().String("host", "", "Only this vhost")
+	httpLatencyCmd.Flags().String("sort", "count", "Order routes by count or p99")
+	httpLatencyCmd.Flags().Int("limit", 20, "Number of routes to show")
+	pipelineCmd.Flags().StringP("config", "c", "/etc/mlog/mlog.yaml", "Config file path")
+	dbCmd.PersistentFlags().StringP("config", "c", "/etc/mlog/mlog.yaml", "Config file path")
+	dbMaintenanceCmd.Flags().Bool("run", false, "Run maintenance now before showing the history")
+	dbMaintenanceCmd.Flags().Int("limit", 20, "Number of runs to show")
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -77,6 +196,13 @@ func runServe(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	loc, err := timestamp.LoadLocation(cfg.Server.Timezone)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: invalid timezone %q: %v\n", cfg.Server.Timezone, err)
+		os.Exit(1)
+	}
+	timestamp.SetLocation(loc)
+
 	if os.Geteuid() != 0 {
 		fmt.Println("Warning: Not running as root. Some logs may not be accessible.")
 	}
@@ -89,26 +215,161 @@ func runServe(cmd *cobra.Command, args []string) {
 
 	fmt.Printf("Mlog serving on: %s\n", cfg.Server.ID)
 
+	maintenanceInterval, err := time.ParseDuration(cfg.Database.MaintenanceInterval)
+	if err != nil || maintenanceInterval <= 0 {
+		maintenanceInterval = time.Hour
+	}
+	if err := db.EnableIncrementalVacuum(); err != nil {
+		fmt.Fprintf(os.Stderr, "DB error: %v\n", err)
+		os.Exit(1)
+	}
+	stopMaintenance := make(chan struct{})
+	maintenanceDone := make(chan struct{})
+	go func() {
+		db.Maintain(cfg.Database, maintenanceInterval, stopMaintenance)
+		close(maintenanceDone)
+	}()
+	defer func() {
+		close(stopMaintenance)
+		<-maintenanceDone
+	}()
+
 	w := monitor.NewWatcher(cfg.Server.ID)
+	if d, err := time.ParseDuration(cfg.Server.PollingInterval); err == nil {
+		w.SetPollInterval(d)
+	}
+	w.SetPipeline(cfg.Monitoring)
 
 	for _, f := range cfg.SSH.LogFiles {
 		if exists(f) {
-			w.AddPath(f)
+			w.AddSource(f, "auth", "ssh")
 		}
 	}
 
 	if cfg.Application.Nginx.Enabled {
-		w.AddPath(cfg.Application.Nginx.AccessLog)
-		w.AddPath(cfg.Application.Nginx.ErrorLog)
+		if p, err := application.NewNginxFormatParser(cfg.Server.ID, cfg.Application.Nginx.LogFormat); err == nil {
+			w.AddSourceWith(cfg.Application.Nginx.AccessLog, parser.Func(p.ParseAccess))
+		}
+		w.AddSource(cfg.Application.Nginx.ErrorLog, "nginx-error")
 	}
 
 	if cfg.Application.Apache.Enabled {
-		w.AddPath(cfg.Application.Apache.AccessLog)
-		w.AddPath(cfg.Application.Apache.ErrorLog)
+		if p, err := application.NewApacheFormatParser(cfg.Server.ID, cfg.Application.Apache.LogFormat); err == nil {
+			w.AddSourceWith(cfg.Application.Apache.AccessLog, parser.Func(p.ParseAccess))
+		}
+		w.AddSource(cfg.Application.Apache.ErrorLog, "apache-error")
 	}
 
 	if cfg.Application.PM2.Enabled {
 		expandPath(&cfg.Application.PM2.LogDir)
+		if r, err := multiline.Compile(cfg.Application.PM2.Multiline); err == nil {
+			w.SetMultiline(cfg.Application.PM2.LogDir, r)
+		}
+		if err := w.AddDir(cfg.Application.PM2.LogDir, "pm2", pm2Match(cfg.Application.PM2)); err != nil {
+			fmt.Fprintf(os.Stderr, "PM2 log dir error: %v\n", err)
+		}
+	}
+
+	for _, c := range cfg.Application.Custom {
+		if !c.Enabled {
+			continue
+		}
+		if r, err := multiline.Compile(c.Multiline); err == nil {
+			w.SetMultiline(c.Path, r)
+		}
+		var err error
+		switch {
+		case c.Pattern != "" || c.Grok != "":
+			var p *custom.Parser
+			if p, err = custom.New(cfg.Server.ID, c); err == nil {
+				err = w.AddSourceWith(c.Path, p)
+			}
+		case c.Parser != "":
+			err = w.AddSource(c.Path, c.Parser)
+		default:
+			err = w.AddPath(c.Path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Custom log %s error: %v\n", c.Name, err)
+		}
+	}
+
+	for _, c := range cfg.Application.JSONAccess {
+		if !c.Enabled {
+			continue
+		}
+		p, err := application.NewJSONAccessParser(cfg.Server.ID, c)
+		if err == nil {
+			err = w.AddSourceWith(c.Path, parser.Func(p.ParseAccess))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "JSON access log %s error: %v\n", c.Name, err)
+		}
+	}
+
+	w.AddObserver(errorgroup.NewGrouper(cfg.Server.ID))
+	if cfg.Application.Latency.Enabled {
+		w.AddObserver(latency.NewTracker(cfg.Application.Latency.MaxRoutes))
+	}
+
+	if cfg.SSH.Enabled && cfg.SSH.TrackSessions {
+		w.AddObserver(session.NewTracker())
+	}
+
+	if cfg.Security.Enabled {
+		// Kernel lines tend to be copied into several files; read only the
+		// first one present to avoid counting each packet twice.
+		for _, f := range cfg.Security.PortScan.LogFiles {
+			if exists(f) {
+				w.AddSource(f, "firewall")
+				break
+			}
+		}
+		w.AddObserver(detector.NewBruteForce(cfg.Server.ID, cfg.Security.BruteForce))
+		w.AddObserver(detector.NewPortScan(cfg.Server.ID, cfg.Security.PortScan))
+	}
+
+	if cfg.System.Enabled {
+		// syslog and messages are the Debian and Red Hat names for the same
+		// log; where both exist they hold the same lines.
+		for _, f := range cfg.System.LogFiles {
+			if exists(f) {
+				w.AddSource(f, "systemd")
+				break
+			}
+		}
+		kernelLog := false
+		for _, f := range cfg.System.KernelLogFiles {
+			if exists(f) {
+				w.AddSource(f, "kernel")
+				kernelLog = true
+				break
+			}
+		}
+		// After the port scan files, which may already feed the firewall
+		// parser.
+		if !kernelLog && cfg.System.Kmsg {
+			if err := w.AddKmsg(cfg.System.KmsgPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Kernel ring buffer error: %v\n", err)
+			}
+		}
+		if cfg.System.AuditLog != "" && exists(cfg.System.AuditLog) {
+			w.AddSource(cfg.System.AuditLog, "audit")
+		}
+	}
+
+	// After the log files, so the journal only covers what they do not.
+	if cfg.System.Enabled && cfg.System.Journalctl {
+		parsers := make(map[string][]string)
+		for _, jp := range cfg.System.JournalParsers {
+			parsers[jp.Match] = []string{jp.Parser}
+		}
+		if err := w.AddJournal(monitor.JournalOptions{
+			Command: cfg.System.JournalctlPath,
+			Parsers: parsers,
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "Journal error: %v\n", err)
+		}
 	}
 
 	if err := w.Start(); err != nil {
@@ -118,7 +379,13 @@ func runServe(cmd *cobra.Command, args []string) {
 	defer w.Stop()
 
 	fmt.Println("Monitoring started. Press Ctrl+C to stop.")
-	select {}
+
+	// Return on SIGINT/SIGTERM (mlog stop) so the deferred Stop writes out
+	// the events still queued.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	fmt.Println("Stopping...")
 }
 
 func runDashboard(cmd *cobra.Command, args []string) {
@@ -169,6 +436,626 @@ func runQuery(cmd *cobra.Command, args []string) {
 	}
 }
 
+func runSessions(cmd *cobra.Command, args []string) {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, _ := loadOrCreateConfig(configPath)
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+
+	db.Init(cfg.Database.Path)
+	defer db.Close()
+
+	user, _ := cmd.Flags().GetString("user")
+	ip, _ := cmd.Flags().GetString("ip")
+	limit, _ := cmd.Flags().GetInt("limit")
+	q := &db.SessionQuery{Username: user, SourceIP: ip, Limit: limit}
+
+	for _, f := range []struct {
+		name string
+		dst  **time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		v, _ := cmd.Flags().GetString(f.name)
+		if v == "" {
+			continue
+		}
+		t, err := parseTimeFlag(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --%s: %v\n", f.name, err)
+			os.Exit(1)
+		}
+		*f.dst = &t
+	}
+
+	sessions, err := db.QuerySessions(q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		return
+	}
+
+	for _, s := range sessions {
+		end := "-"
+		duration := "-"
+		if !s.DisconnectedAt.IsZero() {
+			end = s.DisconnectedAt.Format("2006-01-02 15:04:05")
+			duration = (time.Duration(s.Duration) * time.Second).String()
+		} else if s.Status == types.SessionActive {
+			duration = time.Since(s.ConnectedAt).Truncate(time.Second).String()
+		}
+		fmt.Printf("%-19s  %-19s  %-10s %-12s %-15s %-6d %-10s %s\n",
+			s.ConnectedAt.Format("2006-01-02 15:04:05"), end, duration,
+			s.Username, s.SourceIP, s.SourcePort, s.AuthMethod, s.Status)
+	}
+}
+
+func runAccounts(cmd *cobra.Command, args []string) {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, _ := loadOrCreateConfig(configPath)
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+
+	db.Init(cfg.Database.Path)
+	defer db.Close()
+
+	user, _ := cmd.Flags().GetString("user")
+	limit, _ := cmd.Flags().GetInt("limit")
+	q := &db.EventQuery{EventType: "ACCOUNT_", Username: user, Limit: limit}
+	if v, _ := cmd.Flags().GetString("since"); v != "" {
+		t, err := parseTimeFlag(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --since: %v\n", err)
+			os.Exit(1)
+		}
+		q.Since = &t
+	}
+
+	events, err := db.QueryEvents(q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		return
+	}
+
+	// Group changes by the affected user, oldest first; group-only
+	// changes such as groupadd are listed under their own heading.
+	var names []string
+	byUser := make(map[string][]*types.Event)
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		name := e.Username
+		if name == "" {
+			name = "(groups)"
+		}
+		if _, ok := byUser[name]; !ok {
+			names = append(names, name)
+		}
+		byUser[name] = append(byUser[name], e)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("\033[1m%s\033[0m\n", name)
+		for _, e := range byUser[name] {
+			actor := ""
+			if a, ok := e.GetMetadata("actor").(string); ok {
+				actor = " (by " + a + ")"
+			}
+			fmt.Printf("  %s  %-30s %s%s\n", e.Timestamp.Format("2006-01-02 15:04:05"), e.EventType, e.Message, actor)
+		}
+	}
+}
+
+// unitHistory is what `mlog services` knows about one unit.
+type unitHistory struct {
+	name     string
+	starts   int
+	stops    int
+	failures int
+	restarts int
+	limits   int
+	lastExit string
+	crashes  []*types.Event
+}
+
+func runServices(cmd *cobra.Command, args []string) {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, _ := loadOrCreateConfig(configPath)
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+
+	db.Init(cfg.Database.Path)
+	defer db.Close()
+
+	unit, _ := cmd.Flags().GetString("unit")
+	threshold, _ := cmd.Flags().GetInt("threshold")
+	all, _ := cmd.Flags().GetBool("all")
+	window, _ := cmd.Flags().GetDuration("window")
+	sinceFlag, _ := cmd.Flags().GetString("since")
+	since, err := parseTimeFlag(sinceFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --since: %v\n", err)
+		os.Exit(1)
+	}
+
+	events, err := db.QueryEvents(&db.EventQuery{EventType: "SERVICE_", Since: &since, Limit: 100000})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		return
+	}
+
+	// Oldest first, so the last exit status is the most recent one.
+	units := make(map[string]*unitHistory)
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		name := systemd.Unit(e)
+		if name == "" || unit != "" && name != unit {
+			continue
+		}
+		u := units[name]
+		if u == nil {
+			u = &unitHistory{name: name}
+			units[name] = u
+		}
+		switch e.EventType {
+		case types.EventServiceStarted:
+			u.starts++
+		case types.EventServiceStopped:
+			u.stops++
+		case types.EventServiceFailed:
+			u.failures++
+			u.crashes = append(u.crashes, e)
+		case types.EventServiceRestarting:
+			u.restarts++
+			u.crashes = append(u.crashes, e)
+		case types.EventServiceRestartLimit:
+			u.limits++
+			u.crashes = append(u.crashes, e)
+		case types.EventServiceExited:
+			if status, ok := e.GetMetadata("exit_status").(string); ok {
+				u.lastExit = status
+			}
+			if e.Severity != types.SeverityInfo {
+				u.crashes = append(u.crashes, e)
+			}
+		}
+	}
+
+	var list []*unitHistory
+	for _, u := range units {
+		if all || u.limits > 0 || u.failures >= threshold || u.restarts >= threshold {
+			list = append(list, u)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i].crashes) != len(list[j].crashes) {
+			return len(list[i].crashes) > len(list[j].crashes)
+		}
+		return list[i].name < list[j].name
+	})
+	if len(list) == 0 {
+		fmt.Printf("No flapping units since %s\n", since.Format("2006-01-02 15:04"))
+		return
+	}
+
+	httpErrors := httpErrorTimes(since)
+
+	fmt.Printf("%-32s %6s %6s %6s %8s %6s %6s  %s\n", "UNIT", "STARTS", "STOPS", "FAILS", "RESTARTS", "LIMIT", "5XX", "LAST EXIT")
+	for _, u := range list {
+		lastExit := u.lastExit
+		if lastExit == "" {
+			lastExit = "-"
+		}
+		fmt.Printf("%-32s %6d %6d %6d %8d %6d %6d  %s\n", u.name, u.starts, u.stops, u.failures, u.restarts, u.limits,
+			countAfter(httpErrors, u.crashes, window), lastExit)
+	}
+
+	// The recent crashes of each unit, with the 5xx responses that
+	// followed each one.
+	for _, u := range list {
+		if len(u.crashes) == 0 {
+			continue
+		}
+		fmt.Printf("\n\033[1m%s\033[0m\n", u.name)
+		crashes := u.crashes
+		if len(crashes) > 20 {
+			crashes = crashes[len(crashes)-20:]
+		}
+		for _, e := range crashes {
+			n := countAfter(httpErrors, []*types.Event{e}, window)
+			fmt.Printf("  %s  %-22s %-60s 5xx: %d\n", e.Timestamp.Format("2006-01-02 15:04:05"), e.EventType, e.Message, n)
+		}
+	}
+}
+
+// httpErrorTimes returns when the web server logs recorded a 5xx response
+// since the given time, oldest first.
+func httpErrorTimes(since time.Time) []time.Time {
+	var times []time.Time
+	for _, t := range types.HTTPRequestEvents {
+		events, err := db.QueryEvents(&db.EventQuery{EventType: string(t), Severity: string(types.SeverityError), Since: &since, Limit: 100000})
+		if err != nil {
+			continue
+		}
+		for _, e := range events {
+			if status, ok := e.GetMetadata("status").(float64); ok && status >= 500 {
+				times = append(times, e.Timestamp)
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+// countAfter counts the times that fall within window after any of the
+// events. Each time is counted once, however many events precede it.
+func countAfter(times []time.Time, events []*types.Event, window time.Duration) int {
+	n := 0
+	for _, t := range times {
+		for _, e := range events {
+			if !t.Before(e.Timestamp) && t.Sub(e.Timestamp) <= window {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+func runDBMaintenance(cmd *cobra.Command, args []string) {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, _ := loadOrCreateConfig(configPath)
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+
+	if err := db.Init(cfg.Database.Path); err != nil {
+		fmt.Fprintf(os.Stderr, "DB error: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if run, _ := cmd.Flags().GetBool("run"); run {
+		if err := db.EnableIncrementalVacuum(); err != nil {
+			fmt.Fprintf(os.Stderr, "Maintenance error: %v\n", err)
+			os.Exit(1)
+		}
+		if _, err := db.RunMaintenance(cfg.Database); err != nil {
+			fmt.Fprintf(os.Stderr, "Maintenance error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	limit, _ := cmd.Flags().GetInt("limit")
+	history, err := db.MaintenanceHistory(limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Retention: %d days, size limit: %d MB\n\n", cfg.Database.RetentionDays, cfg.Database.MaxSizeMB)
+	fmt.Printf("%-19s  %10s %10s %10s %10s  %s\n", "RAN AT", "EVENTS", "SESSIONS", "INCIDENTS", "EVICTED", "SIZE")
+	for _, r := range history {
+		fmt.Printf("%-19s  %10d %10d %10d %10d  %s -> %s\n",
+			r.RanAt.Format("2006-01-02 15:04:05"),
+			r.EventsDeleted, r.SessionsDeleted, r.IncidentsDeleted, r.EventsEvicted,
+			formatBytes(r.SizeBefore), formatBytes(r.SizeAfter))
+	}
+}
+
+func runDBMigrate(cmd *cobra.Command, args []string) {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, _ := loadOrCreateConfig(configPath)
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+
+	if err := db.Open(cfg.Database.Path); err != nil {
+		fmt.Fprintf(os.Stderr, "DB error: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	applied, err := db.Migrate()
+	for _, m := range applied {
+		fmt.Printf("Applied %3d  %s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(applied) == 0 {
+		fmt.Printf("Schema is up to date (version %d)\n", db.LatestVersion())
+	}
+}
+
+func runDBStatus(cmd *cobra.Command, args []string) {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, _ := loadOrCreateConfig(configPath)
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+
+	// Open instead of Init: status must not apply what it reports as pending.
+	if err := db.Open(cfg.Database.Path); err != nil {
+		fmt.Fprintf(os.Stderr, "DB error: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		os.Exit(1)
+	}
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		os.Exit(1)
+	}
+
+	version := 0
+	if len(applied) > 0 {
+		version = applied[len(applied)-1].Version
+	}
+	fmt.Printf("Database: %s\n", cfg.Database.Path)
+	fmt.Printf("Schema version: %d (binary supports %d)\n\n", version, db.LatestVersion())
+
+	fmt.Printf("%-7s  %-8s  %-19s  %s\n", "VERSION", "STATE", "APPLIED AT", "NAME")
+	for _, m := range applied {
+		fmt.Printf("%-7d  %-8s  %-19s  %s\n", m.Version, "applied", m.AppliedAt.Format("2006-01-02 15:04:05"), m.Name)
+	}
+	for _, m := range pending {
+		fmt.Printf("%-7d  %-8s  %-19s  %s\n", m.Version, "pending", "-", m.Name)
+	}
+}
+
+func runPipeline(cmd *cobra.Command, args []string) {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, _ := loadOrCreateConfig(configPath)
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+
+	if err := db.Init(cfg.Database.Path); err != nil {
+		fmt.Fprintf(os.Stderr, "DB error: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	s, err := monitor.LoadStats()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		os.Exit(1)
+	}
+	if s == nil {
+		fmt.Println("No pipeline metrics recorded; is mlog serve running?")
+		return
+	}
+
+	fmt.Printf("Updated:       %s (%s ago)\n", s.UpdatedAt.Local().Format("2006-01-02 15:04:05"), time.Since(s.UpdatedAt).Round(time.Second))
+	fmt.Printf("Queue:         %d / %d (overflow: %s)\n", s.QueueDepth, s.QueueCapacity, s.Overflow)
+	fmt.Printf("Enqueued:      %d\n", s.Enqueued)
+	fmt.Printf("Written:       %d in %d batches\n", s.Written, s.Batches)
+	fmt.Printf("Last batch:    %d events in %s\n", s.LastBatch, s.LastFlush.Round(time.Microsecond))
+	fmt.Printf("Blocked:       %d pushes, %s waiting\n", s.Blocked, s.BlockedTime.Round(time.Millisecond))
+	fmt.Printf("Dropped:       %d\n", s.Dropped)
+	fmt.Printf("Failed:        %d\n", s.Failed)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func runErrors(cmd *cobra.Command, args []string) {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, _ := loadOrCreateConfig(configPath)
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+
+	db.Init(cfg.Database.Path)
+	defer db.Close()
+
+	typeFlag, _ := cmd.Flags().GetString("type")
+	order, _ := cmd.Flags().GetString("sort")
+	limit, _ := cmd.Flags().GetInt("limit")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	sinceFlag, _ := cmd.Flags().GetString("since")
+	since, err := parseTimeFlag(sinceFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --since: %v\n", err)
+		os.Exit(1)
+	}
+
+	q := &db.ErrorGroupQuery{Since: &since}
+	switch strings.ToLower(typeFlag) {
+	case "":
+	case "nginx":
+		q.EventType = string(types.EventNginxError)
+	case "apache":
+		q.EventType = string(types.EventApacheError)
+	case "pm2":
+		q.EventType = string(types.EventPM2Error)
+	default:
+		q.EventType = strings.ToUpper(typeFlag)
+	}
+	groups, err := db.QueryErrorGroups(q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		return
+	}
+	if len(groups) == 0 {
+		fmt.Println("No errors recorded.")
+		return
+	}
+
+	now := time.Now()
+	switch order {
+	case "count":
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].Count > groups[j].Count })
+	case "recent":
+		// Already most recently seen first.
+	case "new":
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].FirstSeen.After(groups[j].FirstSeen) })
+	default:
+		sort.SliceStable(groups, func(i, j int) bool { return errorgroup.Score(groups[i], now) > errorgroup.Score(groups[j], now) })
+	}
+
+	fmt.Printf("\033[1m%8s  %-10s %-10s %-12s %s\033[0m\n", "COUNT", "LAST SEEN", "FIRST SEEN", "TYPE", "ERROR")
+	for i, g := range groups {
+		if i == limit {
+			fmt.Printf("\033[90m... %d more groups\033[0m\n", len(groups)-limit)
+			break
+		}
+		kind := strings.ToLower(strings.TrimSuffix(string(g.EventType), "_ERROR"))
+		if g.Source != "" {
+			kind += ":" + g.Source
+		}
+		color := ""
+		if now.Sub(g.FirstSeen) < 24*time.Hour {
+			color = "\033[33m" // new today
+		}
+		fmt.Printf("%s%8d  %-10s %-10s %-12s %s\033[0m\n", color, g.Count, ago(now, g.LastSeen), ago(now, g.FirstSeen),
+			trunc(kind, 12), trunc(g.Signature, 100))
+		if verbose {
+			for _, l := range strings.Split(strings.TrimRight(g.Sample, "\n"), "\n") {
+				fmt.Printf("\033[90m%10s%s\033[0m\n", "", trunc(l, 140))
+			}
+		}
+	}
+}
+
+// ago is how long before now t was, in its largest unit.
+func ago(now, t time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
+
+func runHTTPLatency(cmd *cobra.Command, args []string) {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, _ := loadOrCreateConfig(configPath)
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+
+	db.Init(cfg.Database.Path)
+	defer db.Close()
+
+	host, _ := cmd.Flags().GetString("host")
+	order, _ := cmd.Flags().GetString("sort")
+	limit, _ := cmd.Flags().GetInt("limit")
+	sinceFlag, _ := cmd.Flags().GetString("since")
+	since, err := parseTimeFlag(sinceFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --since: %v\n", err)
+		os.Exit(1)
+	}
+
+	hosts, err := latency.Summarize(since, host, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		return
+	}
+	if len(hosts) == 0 {
+		fmt.Println("No request times recorded. Access logs need $request_time (nginx), %D (Apache) or a duration field.")
+		return
+	}
+	routes, err := latency.Summarize(since, host, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query error: %v\n", err)
+		return
+	}
+	if order == "p99" {
+		sort.SliceStable(routes, func(i, j int) bool { return routes[i].Quantile(0.99) > routes[j].Quantile(0.99) })
+	}
+
+	fmt.Printf("\033[1m%-40s %8s %8s %8s %8s %8s %9s\033[0m\n", "VHOST", "REQUESTS", "P50", "P90", "P99", "MAX", "UPSTREAM")
+	for _, s := range hosts {
+		printLatency(vhostName(s.Host), s)
+	}
+
+	fmt.Printf("\n\033[1m%-40s %8s %8s %8s %8s %8s %9s\033[0m\n", "ROUTE", "REQUESTS", "P50", "P90", "P99", "MAX", "UPSTREAM")
+	for i, s := range routes {
+		if i == limit {
+			fmt.Printf("\033[90m... %d more routes\033[0m\n", len(routes)-limit)
+			break
+		}
+		name := strings.TrimSpace(s.Method + " " + s.Route)
+		if host == "" && len(hosts) > 1 {
+			name = vhostName(s.Host) + " " + name
+		}
+		printLatency(name, s)
+	}
+}
+
+func printLatency(name string, s *latency.Stat) {
+	upstream := "-"
+	if s.UpstreamCount > 0 {
+		upstream = formatSeconds(s.UpstreamMean())
+	}
+	fmt.Printf("%-40s %8d %8s %8s %8s %8s %9s\n", trunc(name, 40), s.Count,
+		formatSeconds(s.Quantile(0.5)), formatSeconds(s.Quantile(0.9)), formatSeconds(s.Quantile(0.99)),
+		formatSeconds(s.Max), upstream)
+}
+
+func vhostName(host string) string {
+	if host == "" {
+		return "(default)"
+	}
+	return host
+}
+
+// formatSeconds shows a response time in ms below a second.
+func formatSeconds(s float64) string {
+	if s < 1 {
+		return fmt.Sprintf("%.0fms", s*1000)
+	}
+	return fmt.Sprintf("%.2fs", s)
+}
+
+// parseTimeFlag accepts a duration meaning "that long ago" (with "d" for
+// days), a clock time for today, or a full date and time.
+func parseTimeFlag(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if days, err := strconv.Atoi(strings.TrimSuffix(v, "d")); err == nil && strings.HasSuffix(v, "d") {
+		return time.Now().AddDate(0, 0, -days), nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			now := time.Now()
+			return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q", v)
+}
+
 func runStop(cmd *cobra.Command, args []string) {
 	// Find mlog process using pgrep
 	cmdExec := exec.Command("pgrep", "-f", "mlog serve")
@@ -232,9 +1119,20 @@ func defaultConfig() *types.Config {
 			PollingInterval: "1s",
 		},
 		Database: types.DatabaseConfig{
-			Path:          "/var/lib/mlog/mlog.db",
-			MaxSizeMB:     1000,
-			RetentionDays: 90,
+			Path:                "/var/lib/mlog/mlog.db",
+			MaxSizeMB:           1000,
+			RetentionDays:       90,
+			MaintenanceInterval: "1h",
+		},
+		System: types.SystemConfig{
+			Enabled:        true,
+			LogFiles:       []string{"/var/log/syslog", "/var/log/messages"},
+			KernelLogFiles: []string{"/var/log/kern.log", "/var/log/messages"},
+			Kmsg:           true,
+			KmsgPath:       "/dev/kmsg",
+			AuditLog:       "/var/log/audit/audit.log",
+			Journalctl:     true,
+			JournalctlPath: "journalctl",
 		},
 		SSH: types.SSHConfig{
 			Enabled:       true,
@@ -246,6 +1144,13 @@ func defaultConfig() *types.Config {
 			BruteForce: types.BruteForceConfig{
 				Threshold:      5,
 				WindowMinutes: 5,
+				QuietMinutes:  10,
+			},
+			PortScan: types.PortScanConfig{
+				Threshold:     10,
+				WindowSeconds: 5,
+				QuietSeconds:  60,
+				LogFiles:      []string{"/var/log/kern.log", "/var/log/messages", "/var/log/syslog", "/var/log/ufw.log"},
 			},
 		},
 		Application: types.ApplicationConfig{
@@ -260,11 +1165,29 @@ func defaultConfig() *types.Config {
 				AccessLog:  "/var/log/apache2/access.log",
 				ErrorLog:   "/var/log/apache2/error.log",
 			},
+			Latency: types.LatencyConfig{
+				Enabled:   true,
+				MaxRoutes: 500,
+			},
 			PM2: types.PM2Config{
-				Enabled: true,
-				LogDir:  os.ExpandEnv("$HOME/.pm2/logs"),
+				Enabled:     true,
+				LogDir:      os.ExpandEnv("$HOME/.pm2/logs"),
+				WatchStdout: true,
+				WatchStderr: true,
+				Multiline: types.MultilineConfig{
+					Continuation: multiline.NodeContinuation,
+					MaxLines:     200,
+					Timeout:      "1s",
+				},
 			},
 		},
+		Monitoring: types.MonitoringConfig{
+			Realtime:      true,
+			BufferSize:    10000,
+			BatchSize:     500,
+			FlushInterval: "500ms",
+			Overflow:      "block",
+		},
 	}
 }
 
@@ -283,11 +1206,36 @@ func exists(path string) bool {
 
 func expandPath(p *string) {
 	*p = os.ExpandEnv(*p)
+	if *p == "~" || strings.HasPrefix(*p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			*p = home + (*p)[1:]
+		}
+	}
+}
+
+// pm2Match selects the PM2 log files to follow and tags their events with
+// the app name taken from the file name.
+func pm2Match(cfg types.PM2Config) monitor.MatchFunc {
+	return func(name string) (map[string]string, bool) {
+		app, stream, instance, ok := application.ParsePM2LogName(name)
+		if !ok {
+			return nil, false
+		}
+		if stream == "out" && !cfg.WatchStdout || stream == "error" && !cfg.WatchStderr {
+			return nil, false
+		}
+		tags := map[string]string{"app": app, "stream": stream}
+		if instance != "" {
+			tags["instance"] = instance
+		}
+		return tags, true
+	}
 }
 
 // Dashboard for live view
 type Dashboard struct {
 	events   []*types.Event
+	latency  []*latency.Stat
 	mu       sync.RWMutex
 	stopCh   chan bool
 	maxLines int
@@ -302,14 +1250,23 @@ func (d *Dashboard) Start() {
 func (d *Dashboard) pollEvents() {
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
+	var latencyAt time.Time
 
 	for {
 		select {
-		case <-ticker.C:
+		case now := <-ticker.C:
 			events, _ := db.QueryEvents(&db.EventQuery{Limit: d.maxLines})
 			d.mu.Lock()
 			d.events = events
 			d.mu.Unlock()
+			// Latency is written once a minute; no need to read it as often.
+			if now.Sub(latencyAt) >= 10*time.Second {
+				stats, _ := latency.Summarize(now.Add(-5*time.Minute), "", false)
+				d.mu.Lock()
+				d.latency = stats
+				d.mu.Unlock()
+				latencyAt = now
+			}
 			d.render()
 		case <-d.stopCh:
 			return
@@ -320,6 +1277,7 @@ func (d *Dashboard) pollEvents() {
 func (d *Dashboard) render() {
 	d.mu.RLock()
 	events := d.events
+	stats := d.latency
 	d.mu.RUnlock()
 
 	fmt.Print("\033[2J\033[H")
@@ -336,6 +1294,20 @@ func (d *Dashboard) render() {
 	fmt.Printf("\033[90m%s\033[0m", out)
 	fmt.Println("└────────────────────────────────────────────────────────────────┘\033[0m")
 
+	if len(stats) > 0 {
+		fmt.Println("\033[1;35m┌────────────────────────────────────────────────────────────────┐")
+		fmt.Println("│ HTTP LATENCY (last 5 min)                                    │")
+		fmt.Println("├────────────────────────────────────────────────────────────────┤\033[0m")
+		for i, s := range stats {
+			if i == 5 {
+				break
+			}
+			fmt.Printf("  %-24s %7d req  p50 %-7s p90 %-7s p99 %s\n", trunc(vhostName(s.Host), 24), s.Count,
+				formatSeconds(s.Quantile(0.5)), formatSeconds(s.Quantile(0.9)), formatSeconds(s.Quantile(0.99)))
+		}
+		fmt.Println("\033[1;35m└────────────────────────────────────────────────────────────────┘\033[0m")
+	}
+
 	fmt.Println("\033[1;36m┌────────────────────────────────────────────────────────────────┐")
 	fmt.Println("│ LIVE LOGS                                                    │")
 	fmt.Println("├────────────────────────────────────────────────────────────────┤\033[0m")
@@ -3,8 +3,15 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/SdxShadow/Mlog/internal/parser"
+	"github.com/SdxShadow/Mlog/internal/parser/application"
+	"github.com/SdxShadow/Mlog/internal/parser/custom"
+	"github.com/SdxShadow/Mlog/internal/parser/grok"
+	"github.com/SdxShadow/Mlog/internal/parser/multiline"
 	"github.com/SdxShadow/Mlog/pkg/types"
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
 )
 
@@ -18,18 +25,37 @@ func Load(path string) (*types.Config, error) {
 	viper.SetDefault("database.path", "/var/lib/mlog/mlog.db")
 	viper.SetDefault("database.max_size_mb", 1000)
 	viper.SetDefault("database.retention_days", 90)
+	viper.SetDefault("database.maintenance_interval", "1h")
 	viper.SetDefault("ssh.enabled", true)
 	viper.SetDefault("ssh.track_sessions", true)
 	viper.SetDefault("security.enabled", true)
 	viper.SetDefault("security.brute_force.threshold", 5)
 	viper.SetDefault("security.brute_force.window_minutes", 5)
+	viper.SetDefault("security.brute_force.quiet_minutes", 10)
 	viper.SetDefault("security.port_scan.threshold", 10)
 	viper.SetDefault("security.port_scan.window_seconds", 5)
+	viper.SetDefault("security.port_scan.quiet_seconds", 60)
+	viper.SetDefault("security.port_scan.log_files", []string{"/var/log/kern.log", "/var/log/messages", "/var/log/syslog", "/var/log/ufw.log"})
 	viper.SetDefault("system.enabled", true)
+	viper.SetDefault("system.kernel_log_files", []string{"/var/log/kern.log", "/var/log/messages"})
+	viper.SetDefault("system.kmsg", true)
+	viper.SetDefault("system.kmsg_path", "/dev/kmsg")
+	viper.SetDefault("system.audit_log", "/var/log/audit/audit.log")
 	viper.SetDefault("system.journalctl", true)
+	viper.SetDefault("system.journalctl_path", "journalctl")
 	viper.SetDefault("application.enabled", true)
+	viper.SetDefault("application.latency.enabled", true)
+	viper.SetDefault("application.latency.max_routes", 500)
+	viper.SetDefault("application.pm2.watch_stdout", true)
+	viper.SetDefault("application.pm2.watch_stderr", true)
+	viper.SetDefault("application.pm2.multiline.continuation", multiline.NodeContinuation)
+	viper.SetDefault("application.pm2.multiline.max_lines", 200)
+	viper.SetDefault("application.pm2.multiline.timeout", "1s")
 	viper.SetDefault("monitoring.realtime", true)
-	viper.SetDefault("monitoring.buffer_size", 100)
+	viper.SetDefault("monitoring.buffer_size", 10000)
+	viper.SetDefault("monitoring.batch_size", 500)
+	viper.SetDefault("monitoring.flush_interval", "500ms")
+	viper.SetDefault("monitoring.overflow", "block")
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -39,7 +65,11 @@ func Load(path string) (*types.Config, error) {
 	}
 
 	cfg = &types.Config{}
-	if err := viper.Unmarshal(cfg); err != nil {
+	// The config structs are tagged for YAML; decode with the same names so
+	// snake_case keys such as polling_interval reach their fields.
+	if err := viper.Unmarshal(cfg, func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = "yaml"
+	}); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
@@ -51,6 +81,62 @@ func Load(path string) (*types.Config, error) {
 		cfg.Server.ID = hostname
 	}
 
+	if err := grok.LoadFiles(cfg.Application.GrokPatterns); err != nil {
+		return nil, fmt.Errorf("failed to load grok patterns: %w", err)
+	}
+
+	for _, jp := range cfg.System.JournalParsers {
+		if jp.Match == "" {
+			return nil, fmt.Errorf("journal_parsers: match is required")
+		}
+		if !parser.Exists(jp.Parser) {
+			return nil, fmt.Errorf("journal_parsers %s: unknown parser %q (known: %s)", jp.Match, jp.Parser, strings.Join(parser.Names(), ", "))
+		}
+	}
+
+	// Compiling here reports bad patterns at startup; the compiled grok
+	// expressions are cached for when the sources are added.
+	if _, err := application.NewNginxFormatParser(cfg.Server.ID, cfg.Application.Nginx.LogFormat); err != nil {
+		return nil, fmt.Errorf("nginx: %w", err)
+	}
+	if _, err := application.NewApacheFormatParser(cfg.Server.ID, cfg.Application.Apache.LogFormat); err != nil {
+		return nil, fmt.Errorf("apache: %w", err)
+	}
+
+	if _, err := multiline.Compile(cfg.Application.PM2.Multiline); err != nil {
+		return nil, fmt.Errorf("pm2: %w", err)
+	}
+
+	for _, c := range cfg.Application.Custom {
+		if _, err := multiline.Compile(c.Multiline); err != nil {
+			return nil, fmt.Errorf("custom log %q: %w", c.Name, err)
+		}
+		if c.Pattern != "" || c.Grok != "" {
+			if c.Parser != "" {
+				return nil, fmt.Errorf("custom log %q: set either parser or a pattern, not both", c.Name)
+			}
+			if _, err := custom.New(cfg.Server.ID, c); err != nil {
+				return nil, fmt.Errorf("custom log %q: %w", c.Name, err)
+			}
+			continue
+		}
+		if c.Parser != "" && !parser.Exists(c.Parser) {
+			return nil, fmt.Errorf("custom log %q: unknown parser %q (known: %s)", c.Name, c.Parser, strings.Join(parser.Names(), ", "))
+		}
+	}
+
+	for _, c := range cfg.Application.JSONAccess {
+		if _, err := application.NewJSONAccessParser(cfg.Server.ID, c); err != nil {
+			return nil, fmt.Errorf("json access log %q: %w", c.Name, err)
+		}
+	}
+
+	switch cfg.Monitoring.Overflow {
+	case "block", "drop":
+	default:
+		return nil, fmt.Errorf("invalid monitoring.overflow %q: must be block or drop", cfg.Monitoring.Overflow)
+	}
+
 	return cfg, nil
 }
 
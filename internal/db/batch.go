@@ -0,0 +1,69 @@
+package db
+
+import (
+	"time"
+
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// WriteBatch stores events together with the checkpoints of the files
+// they were read from in one transaction. A checkpoint is therefore never
+// ahead of the events it covers, and a crash between batches only means
+// re-reading lines that were not committed. Sources that are not files,
+// such as the journal, keep their position in state, which goes to the
+// config table. Incidents are the open security incidents the detectors
+// have updated since the last batch.
+func WriteBatch(events []*types.Event, incidents []*types.SecurityIncident, checkpoints []*Checkpoint, state map[string]string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(events) > 0 {
+		stmt, err := tx.Prepare(insertEventQuery)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, e := range events {
+			if _, err := stmt.Exec(eventArgs(e)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(incidents) > 0 {
+		stmt, err := tx.Prepare(updateIncidentQuery)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, i := range incidents {
+			if _, err := stmt.Exec(incidentArgs(i)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(checkpoints) > 0 {
+		stmt, err := tx.Prepare(saveCheckpointQuery)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, cp := range checkpoints {
+			if _, err := stmt.Exec(checkpointArgs(cp)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, value := range state {
+		if _, err := tx.Exec(setConfigQuery, key, value, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
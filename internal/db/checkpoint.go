@@ -0,0 +1,54 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Checkpoint records how far a log file has been read. HeadHash covers the
+// first bytes of the file up to the offset and is used to recognise the
+// same file after a restart even when its inode was reused.
+type Checkpoint struct {
+	Path      string
+	Inode     uint64
+	Offset    int64
+	HeadHash  string
+	UpdatedAt time.Time
+}
+
+func GetCheckpoint(path string) (*Checkpoint, error) {
+	cp := &Checkpoint{Path: path}
+	var inode int64
+	var updatedAt string
+	err := db.QueryRow(`SELECT inode, offset, head_hash, updated_at FROM file_checkpoints WHERE path = ?`, path).
+		Scan(&inode, &cp.Offset, &cp.HeadHash, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp.Inode = uint64(inode)
+	cp.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	return cp, nil
+}
+
+const saveCheckpointQuery = `INSERT INTO file_checkpoints (path, inode, offset, head_hash, updated_at)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(path) DO UPDATE SET inode = excluded.inode, offset = excluded.offset,
+		head_hash = excluded.head_hash, updated_at = excluded.updated_at`
+
+func SaveCheckpoint(cp *Checkpoint) error {
+	_, err := db.Exec(saveCheckpointQuery, checkpointArgs(cp)...)
+	return err
+}
+
+func checkpointArgs(cp *Checkpoint) []interface{} {
+	return []interface{}{
+		cp.Path,
+		int64(cp.Inode),
+		cp.Offset,
+		cp.HeadHash,
+		time.Now().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SetConfigValue stores a value in the config table, which holds runtime
+// state shared between the daemon and the CLI.
+func SetConfigValue(key, value string) error {
+	_, err := db.Exec(setConfigQuery, key, value, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+const setConfigQuery = `INSERT INTO config (key, value, updated_at) VALUES (?, ?, ?)
+	ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`
+
+// GetConfigValue returns the value stored under key and when it was last
+// written. A missing key is not an error; the value is then empty.
+func GetConfigValue(key string) (string, time.Time, error) {
+	var value, updatedAt string
+	err := db.QueryRow(`SELECT value, updated_at FROM config WHERE key = ?`, key).Scan(&value, &updatedAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	t, _ := time.Parse(time.RFC3339, updatedAt)
+	return value, t.Local(), nil
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,9 +12,27 @@ import (
 	"github.com/SdxShadow/Mlog/pkg/types"
 )
 
-var db *sql.DB
+var (
+	db     *sql.DB
+	dbPath string
+)
 
+// Init opens the database and applies any pending schema migrations.
 func Init(path string) error {
+	if err := Open(path); err != nil {
+		return err
+	}
+
+	if _, err := Migrate(); err != nil {
+		return fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
+	return nil
+}
+
+// Open opens the database without changing its schema. It refuses a
+// database written by a newer mlog than this binary.
+func Open(path string) error {
 	// Create directory if not exists
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -21,7 +40,9 @@ func Init(path string) error {
 	}
 
 	var err error
-	db, err = sql.Open("sqlite3", path+"?_journal_mode=WAL")
+	// auto_vacuum only takes effect on a new database; existing ones are
+	// converted by EnableIncrementalVacuum.
+	db, err = sql.Open("sqlite3", path+"?_journal_mode=WAL&_auto_vacuum=incremental")
 	if err != nil {
 		return fmt.Errorf("failed to open database: %w", err)
 	}
@@ -29,85 +50,19 @@ func Init(path string) error {
 	if err = db.Ping(); err != nil {
 		return fmt.Errorf("failed to ping database: %w", err)
 	}
+	dbPath = path
 
-	if err = createSchema(); err != nil {
-		return fmt.Errorf("failed to create schema: %w", err)
+	version, err := SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > LatestVersion() {
+		return fmt.Errorf("database schema version %d is newer than this mlog supports (%d); upgrade mlog", version, LatestVersion())
 	}
 
 	return nil
 }
 
-func createSchema() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS events (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		timestamp TEXT NOT NULL,
-		server_id TEXT NOT NULL,
-		event_type TEXT NOT NULL,
-		severity TEXT NOT NULL,
-		source_ip TEXT,
-		dest_ip TEXT,
-		source_port INTEGER,
-		username TEXT,
-		message TEXT,
-		raw_log TEXT,
-		metadata TEXT,
-		created_at TEXT DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_events_event_type ON events(event_type);
-	CREATE INDEX IF NOT EXISTS idx_events_source_ip ON events(source_ip);
-	CREATE INDEX IF NOT EXISTS idx_events_username ON events(username);
-	CREATE INDEX IF NOT EXISTS idx_events_severity ON events(severity);
-
-	CREATE TABLE IF NOT EXISTS ssh_sessions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		session_id TEXT UNIQUE NOT NULL,
-		username TEXT NOT NULL,
-		source_ip TEXT NOT NULL,
-		source_port INTEGER,
-		connected_at TEXT NOT NULL,
-		disconnected_at TEXT,
-		duration_seconds INTEGER,
-		auth_method TEXT,
-		client_version TEXT,
-		status TEXT DEFAULT 'active'
-	);
-
-	CREATE TABLE IF NOT EXISTS security_incidents (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		incident_type TEXT NOT NULL,
-		severity TEXT NOT NULL,
-		source_ip TEXT,
-		start_time TEXT NOT NULL,
-		end_time TEXT,
-		event_count INTEGER DEFAULT 1,
-		description TEXT,
-		resolved INTEGER DEFAULT 0,
-		metadata TEXT
-	);
-
-	CREATE TABLE IF NOT EXISTS config (
-		key TEXT PRIMARY KEY,
-		value TEXT NOT NULL,
-		updated_at TEXT DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS server_info (
-		id TEXT PRIMARY KEY,
-		hostname TEXT,
-		os_version TEXT,
-		arch TEXT,
-		first_seen TEXT,
-		last_seen TEXT
-	);
-	`
-
-	_, err := db.Exec(schema)
-	return err
-}
-
 func Close() error {
 	if db != nil {
 		return db.Close()
@@ -115,12 +70,20 @@ func Close() error {
 	return nil
 }
 
+const insertEventQuery = `INSERT INTO events (timestamp, server_id, event_type, severity, source_ip, dest_ip, source_port, username, message, raw_log, metadata)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
 func InsertEvent(event *types.Event) error {
-	query := `INSERT INTO events (timestamp, server_id, event_type, severity, source_ip, dest_ip, source_port, username, message, raw_log, metadata)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(insertEventQuery, eventArgs(event)...)
+	return err
+}
 
-	_, err := db.Exec(query,
-		event.Timestamp.Format(time.RFC3339),
+// eventArgs returns the insertEventQuery parameters for event. Timestamps
+// are stored in UTC so that events parsed from logs with different offsets
+// still sort and compare correctly as text.
+func eventArgs(event *types.Event) []interface{} {
+	return []interface{}{
+		event.Timestamp.UTC().Format(time.RFC3339),
 		event.ServerID,
 		event.EventType,
 		event.Severity,
@@ -131,9 +94,7 @@ func InsertEvent(event *types.Event) error {
 		event.Message,
 		event.RawLog,
 		event.MetadataJSON(),
-	)
-
-	return err
+	}
 }
 
 type EventQuery struct {
@@ -169,11 +130,11 @@ func QueryEvents(q *EventQuery) ([]*types.Event, error) {
 	}
 	if q.Since != nil {
 		query += " AND timestamp >= ?"
-		args = append(args, q.Since.Format(time.RFC3339))
+		args = append(args, q.Since.UTC().Format(time.RFC3339))
 	}
 	if q.Until != nil {
 		query += " AND timestamp <= ?"
-		args = append(args, q.Until.Format(time.RFC3339))
+		args = append(args, q.Until.UTC().Format(time.RFC3339))
 	}
 
 	query += " ORDER BY timestamp DESC"
@@ -204,7 +165,12 @@ func QueryEvents(q *EventQuery) ([]*types.Event, error) {
 		if err != nil {
 			return nil, err
 		}
-		e.Timestamp, _ = time.Parse(time.RFC3339, timestamp)
+		if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+			e.Timestamp = t.Local()
+		}
+		if metadata != "" && metadata != "{}" {
+			json.Unmarshal([]byte(metadata), &e.Metadata)
+		}
 		events = append(events, e)
 	}
 
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// SaveErrorGroups adds occurrences to the error groups, creating those
+// not stored yet. Count is the number of new occurrences; the sample is
+// replaced when they are the latest.
+func SaveErrorGroups(groups []*types.ErrorGroup) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO error_groups (fingerprint, event_type, source, signature, sample, first_seen, last_seen, count)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(fingerprint) DO UPDATE SET
+			count = count + excluded.count,
+			first_seen = MIN(first_seen, excluded.first_seen),
+			sample = CASE WHEN excluded.last_seen >= last_seen THEN excluded.sample ELSE sample END,
+			last_seen = MAX(last_seen, excluded.last_seen)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, g := range groups {
+		if _, err := stmt.Exec(g.Fingerprint, g.EventType, g.Source, g.Signature, g.Sample,
+			g.FirstSeen.UTC().Format(time.RFC3339), g.LastSeen.UTC().Format(time.RFC3339), g.Count); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ErrorFingerprints returns the fingerprints of the stored error groups.
+func ErrorFingerprints() (map[string]bool, error) {
+	rows, err := db.Query(`SELECT fingerprint FROM error_groups`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	known := make(map[string]bool)
+	for rows.Next() {
+		var fp string
+		if err := rows.Scan(&fp); err != nil {
+			return nil, err
+		}
+		known[fp] = true
+	}
+	return known, rows.Err()
+}
+
+type ErrorGroupQuery struct {
+	EventType string
+	Since     *time.Time // last seen
+}
+
+// QueryErrorGroups returns the groups seen since the given time, most
+// recently seen first.
+func QueryErrorGroups(q *ErrorGroupQuery) ([]*types.ErrorGroup, error) {
+	query := `SELECT fingerprint, event_type, source, signature, sample, first_seen, last_seen, count
+		FROM error_groups WHERE 1=1`
+	args := []interface{}{}
+
+	if q.EventType != "" {
+		query += " AND event_type = ?"
+		args = append(args, q.EventType)
+	}
+	if q.Since != nil {
+		query += " AND last_seen >= ?"
+		args = append(args, q.Since.UTC().Format(time.RFC3339))
+	}
+	query += " ORDER BY last_seen DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*types.ErrorGroup
+	for rows.Next() {
+		g := &types.ErrorGroup{}
+		var source, sample sql.NullString
+		var firstSeen, lastSeen string
+		if err := rows.Scan(&g.Fingerprint, &g.EventType, &source, &g.Signature, &sample, &firstSeen, &lastSeen, &g.Count); err != nil {
+			return nil, err
+		}
+		g.Source = source.String
+		g.Sample = sample.String
+		if t, err := time.Parse(time.RFC3339, firstSeen); err == nil {
+			g.FirstSeen = t.Local()
+		}
+		if t, err := time.Parse(time.RFC3339, lastSeen); err == nil {
+			g.LastSeen = t.Local()
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+func InsertIncident(i *types.SecurityIncident) error {
+	query := `INSERT INTO security_incidents (incident_type, severity, source_ip, start_time, end_time, event_count, description, resolved, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	res, err := db.Exec(query,
+		i.IncidentType,
+		i.Severity,
+		i.SourceIP,
+		i.StartTime.UTC().Format(time.RFC3339),
+		formatTime(i.EndTime),
+		i.EventCount,
+		i.Description,
+		i.Resolved,
+		i.MetadataJSON(),
+	)
+	if err != nil {
+		return err
+	}
+	i.ID, err = res.LastInsertId()
+	return err
+}
+
+const updateIncidentQuery = `UPDATE security_incidents SET severity = ?, end_time = ?, event_count = ?, description = ?, resolved = ?, metadata = ?
+	WHERE id = ?`
+
+func UpdateIncident(i *types.SecurityIncident) error {
+	_, err := db.Exec(updateIncidentQuery, incidentArgs(i)...)
+	return err
+}
+
+func incidentArgs(i *types.SecurityIncident) []interface{} {
+	return []interface{}{
+		i.Severity,
+		formatTime(i.EndTime),
+		i.EventCount,
+		i.Description,
+		i.Resolved,
+		i.MetadataJSON(),
+		i.ID,
+	}
+}
+
+// OpenIncidents returns the unresolved incidents of one type, so that a
+// detector can carry on with them after a restart.
+func OpenIncidents(incidentType string) ([]*types.SecurityIncident, error) {
+	rows, err := db.Query(`SELECT id, incident_type, severity, source_ip, start_time, end_time, event_count, description, resolved, metadata
+		FROM security_incidents WHERE incident_type = ? AND resolved = 0`, incidentType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var incidents []*types.SecurityIncident
+	for rows.Next() {
+		i := &types.SecurityIncident{}
+		var sourceIP, endTime, description, metadata sql.NullString
+		var startTime string
+		if err := rows.Scan(&i.ID, &i.IncidentType, &i.Severity, &sourceIP, &startTime, &endTime, &i.EventCount, &description, &i.Resolved, &metadata); err != nil {
+			return nil, err
+		}
+		i.SourceIP = sourceIP.String
+		i.Description = description.String
+		i.StartTime, _ = time.Parse(time.RFC3339, startTime)
+		i.EndTime, _ = time.Parse(time.RFC3339, endTime.String)
+		if metadata.String != "" {
+			json.Unmarshal([]byte(metadata.String), &i.Metadata)
+		}
+		incidents = append(incidents, i)
+	}
+	return incidents, rows.Err()
+}
+
+func formatTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
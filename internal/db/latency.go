@@ -0,0 +1,80 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// LatencyRow is the response times of one route over one minute, as a
+// histogram: Bins counts the requests per bin index, and the bins are
+// defined by the latency package. Several rows may cover the same minute
+// and route; they add up.
+type LatencyRow struct {
+	Minute        time.Time
+	Host          string
+	Method        string
+	Route         string
+	Count         int64
+	Total         float64 // seconds
+	Max           float64
+	UpstreamCount int64
+	UpstreamTotal float64
+	Bins          map[int]int64
+}
+
+func InsertLatency(rows []*LatencyRow) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO http_latency (minute, host, method, route, count, total, max, upstream_count, upstream_total, bins)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range rows {
+		bins, _ := json.Marshal(r.Bins)
+		if _, err := stmt.Exec(r.Minute.UTC().Format(time.RFC3339), r.Host, r.Method, r.Route,
+			r.Count, r.Total, r.Max, r.UpstreamCount, r.UpstreamTotal, string(bins)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LatencyRows returns the rows from since on, of one host or of all.
+func LatencyRows(since time.Time, host string) ([]*LatencyRow, error) {
+	query := `SELECT minute, host, method, route, count, total, max, upstream_count, upstream_total, bins
+		FROM http_latency WHERE minute >= ?`
+	args := []interface{}{since.UTC().Format(time.RFC3339)}
+	if host != "" {
+		query += " AND host = ?"
+		args = append(args, host)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*LatencyRow
+	for rows.Next() {
+		r := &LatencyRow{}
+		var minute, bins string
+		if err := rows.Scan(&minute, &r.Host, &r.Method, &r.Route, &r.Count, &r.Total, &r.Max, &r.UpstreamCount, &r.UpstreamTotal, &bins); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339, minute); err == nil {
+			r.Minute = t.Local()
+		}
+		if err := json.Unmarshal([]byte(bins), &r.Bins); err != nil {
+			continue
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
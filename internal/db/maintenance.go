@@ -0,0 +1,259 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// deleteBatch caps how many rows are deleted at a time, whether past the
+// retention window or the oldest events while the database is over its
+// size limit. Small batches keep the write lock short so ingestion is not
+// stalled.
+const deleteBatch = 5000
+
+// maxEvictShare caps the share of the events one maintenance run may
+// evict, so that a limit the events alone cannot meet does not empty the
+// table.
+const maxEvictShare = 0.5
+
+// MaintenanceResult records what one maintenance run removed.
+type MaintenanceResult struct {
+	RanAt            time.Time
+	EventsDeleted    int64
+	SessionsDeleted  int64
+	IncidentsDeleted int64
+	EventsEvicted    int64
+	SizeBefore       int64
+	SizeAfter        int64
+}
+
+// Maintain runs maintenance immediately and then every interval until
+// stop is closed.
+func Maintain(cfg types.DatabaseConfig, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		res, err := RunMaintenance(cfg)
+		if err != nil {
+			log.Printf("Database maintenance failed: %v", err)
+		} else if res.EventsDeleted+res.SessionsDeleted+res.IncidentsDeleted+res.EventsEvicted > 0 {
+			log.Printf("Database maintenance: pruned %d events, %d sessions, %d incidents, evicted %d events (%d -> %d bytes)",
+				res.EventsDeleted, res.SessionsDeleted, res.IncidentsDeleted, res.EventsEvicted, res.SizeBefore, res.SizeAfter)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RunMaintenance applies the retention window and size limit, then
+// returns freed pages to the filesystem and records what it did.
+func RunMaintenance(cfg types.DatabaseConfig) (*MaintenanceResult, error) {
+	res := &MaintenanceResult{RanAt: time.Now(), SizeBefore: fileSize()}
+
+	if cfg.RetentionDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -cfg.RetentionDays).UTC().Format(time.RFC3339)
+		var err error
+		if res.EventsDeleted, err = pruneRows("events", `timestamp < ?`, cutoff); err != nil {
+			return nil, fmt.Errorf("prune events: %w", err)
+		}
+		if res.SessionsDeleted, err = pruneRows("ssh_sessions", `status != ? AND connected_at < ?`, types.SessionActive, cutoff); err != nil {
+			return nil, fmt.Errorf("prune sessions: %w", err)
+		}
+		if res.IncidentsDeleted, err = pruneRows("security_incidents", `resolved = 1 AND COALESCE(end_time, start_time) < ?`, cutoff); err != nil {
+			return nil, fmt.Errorf("prune incidents: %w", err)
+		}
+		if _, err := pruneRows("http_latency", `minute < ?`, cutoff); err != nil {
+			return nil, fmt.Errorf("prune http latency: %w", err)
+		}
+		if _, err := pruneRows("error_groups", `last_seen < ?`, cutoff); err != nil {
+			return nil, fmt.Errorf("prune error groups: %w", err)
+		}
+	}
+
+	if cfg.MaxSizeMB > 0 {
+		limit := int64(cfg.MaxSizeMB) * 1024 * 1024
+		var total int64
+		if err := db.QueryRow("SELECT COUNT(*) FROM events").Scan(&total); err != nil {
+			return nil, err
+		}
+		maxEvict := int64(float64(total) * maxEvictShare)
+		prev := int64(-1)
+		for {
+			used, err := usedSize()
+			if err != nil {
+				return nil, err
+			}
+			if used <= limit {
+				break
+			}
+			// Events are not what fills the database, or not any more:
+			// stop rather than delete them all.
+			if (prev >= 0 && used >= prev) || res.EventsEvicted >= maxEvict {
+				log.Printf("Database is still over its size limit after evicting %d events (%d bytes used)", res.EventsEvicted, used)
+				break
+			}
+			prev = used
+			// Estimate the share of events to drop from how far over the
+			// limit the database is.
+			count := total - res.EventsEvicted
+			batch := count*(used-limit)/used + 1
+			if batch > deleteBatch {
+				batch = deleteBatch
+			}
+			if batch > maxEvict-res.EventsEvicted {
+				batch = maxEvict - res.EventsEvicted
+			}
+			n, err := deleteRows(`DELETE FROM events WHERE id IN (SELECT id FROM events ORDER BY id LIMIT ?)`, batch)
+			if err != nil {
+				return nil, fmt.Errorf("evict events: %w", err)
+			}
+			if n == 0 {
+				break
+			}
+			res.EventsEvicted += n
+		}
+	}
+
+	if err := incrementalVacuum(); err != nil {
+		return nil, fmt.Errorf("incremental vacuum: %w", err)
+	}
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return nil, fmt.Errorf("checkpoint wal: %w", err)
+	}
+
+	res.SizeAfter = fileSize()
+	if err := recordMaintenance(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// EnableIncrementalVacuum converts a database created without
+// auto_vacuum, without which maintenance cannot return freed pages to the
+// filesystem. This needs one full VACUUM, done only once; it holds the
+// database for as long as it takes, so it is not left to the background
+// loop but run before the watcher starts or by mlog db maintenance --run.
+func EnableIncrementalVacuum() error {
+	var mode int
+	if err := db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	if mode == 2 {
+		return nil
+	}
+	log.Printf("Enabling incremental vacuum on %s, this may take a while", dbPath)
+	if _, err := db.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return err
+	}
+	_, err := db.Exec("VACUUM")
+	return err
+}
+
+// incrementalVacuum frees one page per result row, so the rows have to be
+// stepped through rather than executed once.
+func incrementalVacuum() error {
+	rows, err := db.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// pruneRows deletes the rows of table matching where, deleteBatch at a
+// time.
+func pruneRows(table, where string, args ...interface{}) (int64, error) {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE rowid IN (SELECT rowid FROM %s WHERE %s LIMIT %d)`, table, table, where, deleteBatch)
+	var total int64
+	for {
+		n, err := deleteRows(query, args...)
+		total += n
+		if err != nil || n < deleteBatch {
+			return total, err
+		}
+	}
+}
+
+func deleteRows(query string, args ...interface{}) (int64, error) {
+	r, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+// usedSize is the size of the pages holding data, ignoring free pages
+// that the next incremental vacuum will release.
+func usedSize() (int64, error) {
+	var pages, free, pageSize int64
+	if err := db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := db.QueryRow("PRAGMA freelist_count").Scan(&free); err != nil {
+		return 0, err
+	}
+	if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return (pages - free) * pageSize, nil
+}
+
+func fileSize() int64 {
+	var size int64
+	for _, p := range []string{dbPath, dbPath + "-wal"} {
+		if info, err := os.Stat(p); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func recordMaintenance(r *MaintenanceResult) error {
+	query := `INSERT INTO maintenance_log (ran_at, events_deleted, sessions_deleted, incidents_deleted, events_evicted, size_before, size_after)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := db.Exec(query,
+		r.RanAt.UTC().Format(time.RFC3339),
+		r.EventsDeleted,
+		r.SessionsDeleted,
+		r.IncidentsDeleted,
+		r.EventsEvicted,
+		r.SizeBefore,
+		r.SizeAfter,
+	)
+	return err
+}
+
+func MaintenanceHistory(limit int) ([]*MaintenanceResult, error) {
+	rows, err := db.Query(`SELECT ran_at, events_deleted, sessions_deleted, incidents_deleted, events_evicted, size_before, size_after
+		FROM maintenance_log ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*MaintenanceResult
+	for rows.Next() {
+		r := &MaintenanceResult{}
+		var ranAt string
+		if err := rows.Scan(&ranAt, &r.EventsDeleted, &r.SessionsDeleted, &r.IncidentsDeleted, &r.EventsEvicted, &r.SizeBefore, &r.SizeAfter); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339, ranAt); err == nil {
+			r.RanAt = t.Local()
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
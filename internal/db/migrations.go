@@ -0,0 +1,277 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration is one step of the schema history. Migrations are applied in
+// order, each in its own transaction, and are never edited once released;
+// schema changes go into a new migration at the end of the list.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+var migrations = []Migration{
+	{1, "initial schema", `
+	CREATE TABLE IF NOT EXISTS events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp TEXT NOT NULL,
+		server_id TEXT NOT NULL,
+		event_type TEXT NOT NULL,
+		severity TEXT NOT NULL,
+		source_ip TEXT,
+		dest_ip TEXT,
+		source_port INTEGER,
+		username TEXT,
+		message TEXT,
+		raw_log TEXT,
+		metadata TEXT,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_events_event_type ON events(event_type);
+	CREATE INDEX IF NOT EXISTS idx_events_source_ip ON events(source_ip);
+	CREATE INDEX IF NOT EXISTS idx_events_username ON events(username);
+	CREATE INDEX IF NOT EXISTS idx_events_severity ON events(severity);
+
+	CREATE TABLE IF NOT EXISTS ssh_sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id TEXT UNIQUE NOT NULL,
+		username TEXT NOT NULL,
+		source_ip TEXT NOT NULL,
+		source_port INTEGER,
+		connected_at TEXT NOT NULL,
+		disconnected_at TEXT,
+		duration_seconds INTEGER,
+		auth_method TEXT,
+		client_version TEXT,
+		status TEXT DEFAULT 'active'
+	);
+
+	CREATE TABLE IF NOT EXISTS security_incidents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		incident_type TEXT NOT NULL,
+		severity TEXT NOT NULL,
+		source_ip TEXT,
+		start_time TEXT NOT NULL,
+		end_time TEXT,
+		event_count INTEGER DEFAULT 1,
+		description TEXT,
+		resolved INTEGER DEFAULT 0,
+		metadata TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS config (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS server_info (
+		id TEXT PRIMARY KEY,
+		hostname TEXT,
+		os_version TEXT,
+		arch TEXT,
+		first_seen TEXT,
+		last_seen TEXT
+	);
+	`},
+	{2, "file checkpoints", `
+	CREATE TABLE IF NOT EXISTS file_checkpoints (
+		path TEXT PRIMARY KEY,
+		inode INTEGER NOT NULL,
+		offset INTEGER NOT NULL,
+		head_hash TEXT NOT NULL,
+		updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+	);
+	`},
+	{3, "ssh session indexes", `
+	CREATE INDEX IF NOT EXISTS idx_ssh_sessions_connected_at ON ssh_sessions(connected_at);
+	CREATE INDEX IF NOT EXISTS idx_ssh_sessions_status ON ssh_sessions(status);
+	`},
+	{4, "maintenance log", `
+	CREATE TABLE IF NOT EXISTS maintenance_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ran_at TEXT NOT NULL,
+		events_deleted INTEGER DEFAULT 0,
+		sessions_deleted INTEGER DEFAULT 0,
+		incidents_deleted INTEGER DEFAULT 0,
+		events_evicted INTEGER DEFAULT 0,
+		size_before INTEGER,
+		size_after INTEGER
+	);
+	`},
+	{5, "http latency", `
+	CREATE TABLE IF NOT EXISTS http_latency (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		minute TEXT NOT NULL,
+		host TEXT NOT NULL,
+		method TEXT NOT NULL,
+		route TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		total REAL NOT NULL,
+		max REAL NOT NULL,
+		upstream_count INTEGER DEFAULT 0,
+		upstream_total REAL DEFAULT 0,
+		bins TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_http_latency_minute ON http_latency(minute);
+	`},
+	{6, "error groups", `
+	CREATE TABLE IF NOT EXISTS error_groups (
+		fingerprint TEXT PRIMARY KEY,
+		event_type TEXT NOT NULL,
+		source TEXT,
+		signature TEXT NOT NULL,
+		sample TEXT,
+		first_seen TEXT NOT NULL,
+		last_seen TEXT NOT NULL,
+		count INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_error_groups_last_seen ON error_groups(last_seen);
+	`},
+	// Events used to be stored with the offset of the log they came from;
+	// they are now stored in UTC, and compared as text.
+	{7, "utc event timestamps", `
+	UPDATE events
+	SET timestamp = strftime('%Y-%m-%dT%H:%M:%SZ', timestamp)
+	WHERE timestamp NOT LIKE '%Z'
+	AND strftime('%Y-%m-%dT%H:%M:%SZ', timestamp) IS NOT NULL;
+	`},
+}
+
+// LatestVersion is the schema version this binary was built for.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version recorded in the database, 0 for a
+// database that has never been migrated.
+func SchemaVersion() (int, error) {
+	if err := ensureVersionTable(db); err != nil {
+		return 0, err
+	}
+	return currentVersion(db)
+}
+
+// AppliedMigration is a row of schema_version.
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+func AppliedMigrations() ([]AppliedMigration, error) {
+	if err := ensureVersionTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT version, name, applied_at FROM schema_version ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []AppliedMigration
+	for rows.Next() {
+		var m AppliedMigration
+		var appliedAt string
+		if err := rows.Scan(&m.Version, &m.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339, appliedAt); err == nil {
+			m.AppliedAt = t.Local()
+		}
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// PendingMigrations returns the migrations not yet applied.
+func PendingMigrations() ([]Migration, error) {
+	version, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies all pending migrations and returns the ones it ran.
+func Migrate() ([]Migration, error) {
+	var applied []Migration
+	for _, m := range migrations {
+		ran, err := apply(m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		if ran {
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// apply runs one migration unless it is already recorded. The version is
+// checked again inside the transaction in case another mlog process
+// migrated in the meantime.
+func apply(m Migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := ensureVersionTable(tx); err != nil {
+		return false, err
+	}
+	version, err := currentVersion(tx)
+	if err != nil {
+		return false, err
+	}
+	if version >= m.Version {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.Version, m.Name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func ensureVersionTable(e execer) error {
+	_, err := e.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+func currentVersion(e execer) (int, error) {
+	var version sql.NullInt64
+	if err := e.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
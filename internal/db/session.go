@@ -0,0 +1,127 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+const sessionColumns = `id, session_id, username, source_ip, source_port, connected_at, disconnected_at, duration_seconds, auth_method, client_version, status`
+
+func InsertSession(s *types.SSHSession) error {
+	query := `INSERT INTO ssh_sessions (session_id, username, source_ip, source_port, connected_at, auth_method, client_version, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	res, err := db.Exec(query,
+		s.SessionID,
+		s.Username,
+		s.SourceIP,
+		s.SourcePort,
+		s.ConnectedAt.UTC().Format(time.RFC3339),
+		s.AuthMethod,
+		s.ClientVersion,
+		s.Status,
+	)
+	if err != nil {
+		return err
+	}
+	s.ID, err = res.LastInsertId()
+	return err
+}
+
+func UpdateSession(s *types.SSHSession) error {
+	query := `UPDATE ssh_sessions SET disconnected_at = ?, duration_seconds = ?, status = ? WHERE session_id = ?`
+
+	_, err := db.Exec(query,
+		formatTime(s.DisconnectedAt),
+		s.Duration,
+		s.Status,
+		s.SessionID,
+	)
+	return err
+}
+
+// ActiveSessions returns the sessions that have not been closed yet,
+// including those left open when mlog last stopped.
+func ActiveSessions() ([]*types.SSHSession, error) {
+	rows, err := db.Query(`SELECT `+sessionColumns+` FROM ssh_sessions WHERE status = ?`, types.SessionActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSessions(rows)
+}
+
+type SessionQuery struct {
+	Username string
+	SourceIP string
+	Since    *time.Time
+	Until    *time.Time
+	Limit    int
+}
+
+// QuerySessions returns sessions that overlap the [Since, Until] range.
+// Sessions still open count as lasting until now.
+func QuerySessions(q *SessionQuery) ([]*types.SSHSession, error) {
+	query := "SELECT " + sessionColumns + " FROM ssh_sessions WHERE 1=1"
+	args := []interface{}{}
+
+	if q.Username != "" {
+		query += " AND username = ?"
+		args = append(args, q.Username)
+	}
+	if q.SourceIP != "" {
+		query += " AND source_ip = ?"
+		args = append(args, q.SourceIP)
+	}
+	if q.Until != nil {
+		query += " AND connected_at <= ?"
+		args = append(args, q.Until.UTC().Format(time.RFC3339))
+	}
+	if q.Since != nil {
+		query += " AND (disconnected_at IS NULL OR disconnected_at >= ?)"
+		args = append(args, q.Since.UTC().Format(time.RFC3339))
+	}
+
+	query += " ORDER BY connected_at DESC"
+
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	} else {
+		query += " LIMIT 100"
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSessions(rows)
+}
+
+func scanSessions(rows *sql.Rows) ([]*types.SSHSession, error) {
+	var sessions []*types.SSHSession
+	for rows.Next() {
+		s := &types.SSHSession{}
+		var connectedAt string
+		var disconnectedAt, authMethod, clientVersion sql.NullString
+		var sourcePort, duration sql.NullInt64
+		if err := rows.Scan(&s.ID, &s.SessionID, &s.Username, &s.SourceIP, &sourcePort, &connectedAt, &disconnectedAt, &duration, &authMethod, &clientVersion, &s.Status); err != nil {
+			return nil, err
+		}
+		s.SourcePort = int(sourcePort.Int64)
+		s.Duration = duration.Int64
+		s.AuthMethod = authMethod.String
+		s.ClientVersion = clientVersion.String
+		if t, err := time.Parse(time.RFC3339, connectedAt); err == nil {
+			s.ConnectedAt = t.Local()
+		}
+		if t, err := time.Parse(time.RFC3339, disconnectedAt.String); err == nil {
+			s.DisconnectedAt = t.Local()
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,206 @@
+package detector
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/internal/monitor"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// maxTrackedUsers caps the usernames kept per incident; scanners can try
+// thousands.
+const maxTrackedUsers = 50
+
+// BruteForce watches failed SSH logins per source IP. Once a source reaches
+// the threshold within the window it opens an incident, keeps it updated
+// while the attempts continue and resolves it after a quiet period. The
+// window and the quiet period are measured in log time, so that an attack
+// read from a backlog is not cut short.
+type BruteForce struct {
+	serverID  string
+	threshold int
+	window    time.Duration
+	quiet     time.Duration
+	sources   map[string]*bruteForceSource
+	clock     monitor.LogClock
+	updated   map[int64]*types.SecurityIncident
+}
+
+type bruteForceSource struct {
+	attempts []time.Time
+	users    map[string]bool
+	lastSeen time.Time
+	incident *types.SecurityIncident
+}
+
+func NewBruteForce(serverID string, cfg types.BruteForceConfig) *BruteForce {
+	d := &BruteForce{
+		serverID:  serverID,
+		threshold: cfg.Threshold,
+		window:    time.Duration(cfg.WindowMinutes) * time.Minute,
+		quiet:     time.Duration(cfg.QuietMinutes) * time.Minute,
+		sources:   make(map[string]*bruteForceSource),
+		updated:   make(map[int64]*types.SecurityIncident),
+	}
+	if d.threshold <= 0 {
+		d.threshold = 5
+	}
+	if d.window <= 0 {
+		d.window = 5 * time.Minute
+	}
+	if d.quiet <= 0 {
+		d.quiet = d.window
+	}
+
+	open, err := db.OpenIncidents(types.IncidentBruteForce)
+	if err != nil {
+		log.Printf("Failed to load open brute force incidents: %v", err)
+	}
+	for _, i := range open {
+		d.sources[i.SourceIP] = &bruteForceSource{
+			users:    usersFromMetadata(i),
+			lastSeen: i.EndTime,
+			incident: i,
+		}
+		d.clock.Advance(i.EndTime)
+	}
+	return d
+}
+
+func (d *BruteForce) Observe(e *types.Event) []*types.Event {
+	if e.EventType != types.EventSSHFailedAuth || e.SourceIP == "" {
+		return nil
+	}
+	d.clock.Advance(e.Timestamp)
+
+	src, ok := d.sources[e.SourceIP]
+	if !ok {
+		src = &bruteForceSource{users: make(map[string]bool)}
+		d.sources[e.SourceIP] = src
+	}
+
+	src.attempts = append(src.attempts, e.Timestamp)
+	cutoff := e.Timestamp.Add(-d.window)
+	for len(src.attempts) > 0 && src.attempts[0].Before(cutoff) {
+		src.attempts = src.attempts[1:]
+	}
+	if e.Timestamp.After(src.lastSeen) {
+		src.lastSeen = e.Timestamp
+	}
+	if e.Username != "" && len(src.users) < maxTrackedUsers {
+		src.users[e.Username] = true
+	}
+
+	if src.incident != nil {
+		src.incident.EventCount++
+		if e.Timestamp.After(src.incident.EndTime) {
+			src.incident.EndTime = e.Timestamp
+		}
+		d.describe(src)
+		d.updated[src.incident.ID] = src.incident
+		return nil
+	}
+
+	if len(src.attempts) < d.threshold {
+		return nil
+	}
+
+	src.incident = &types.SecurityIncident{
+		IncidentType: types.IncidentBruteForce,
+		Severity:     types.SeverityCritical,
+		SourceIP:     e.SourceIP,
+		StartTime:    src.attempts[0],
+		EndTime:      e.Timestamp,
+		EventCount:   len(src.attempts),
+	}
+	d.describe(src)
+	if err := db.InsertIncident(src.incident); err != nil {
+		// Without an id it could never be updated; the next event from
+		// the source opens it again.
+		log.Printf("Failed to create incident: %v", err)
+		src.incident = nil
+		return nil
+	}
+
+	return []*types.Event{{
+		Timestamp: e.Timestamp,
+		ServerID:  d.serverID,
+		EventType: types.EventBruteForceSuspected,
+		Severity:  types.SeverityCritical,
+		SourceIP:  e.SourceIP,
+		Message:   src.incident.Description,
+		Metadata: map[string]interface{}{
+			"incident_id":    src.incident.ID,
+			"attempts":       len(src.attempts),
+			"window_minutes": int(d.window.Minutes()),
+			"usernames":      sortedKeys(src.users),
+		},
+	}}
+}
+
+// Tick resolves incidents whose source has been quiet long enough and
+// forgets sources that never reached the threshold.
+func (d *BruteForce) Tick(now time.Time) []*types.Event {
+	now = d.clock.Now(now)
+	if now.IsZero() {
+		return nil
+	}
+	for ip, src := range d.sources {
+		if src.incident == nil {
+			if now.Sub(src.lastSeen) > d.window {
+				delete(d.sources, ip)
+			}
+			continue
+		}
+		if now.Sub(src.lastSeen) < d.quiet {
+			continue
+		}
+		src.incident.Resolved = true
+		d.updated[src.incident.ID] = src.incident
+		delete(d.sources, ip)
+	}
+	return nil
+}
+
+func (d *BruteForce) UpdatedIncidents() []*types.SecurityIncident {
+	if len(d.updated) == 0 {
+		return nil
+	}
+	incidents := make([]*types.SecurityIncident, 0, len(d.updated))
+	for _, i := range d.updated {
+		incidents = append(incidents, i)
+	}
+	d.updated = make(map[int64]*types.SecurityIncident)
+	return incidents
+}
+
+func (d *BruteForce) describe(src *bruteForceSource) {
+	i := src.incident
+	i.Description = fmt.Sprintf("SSH brute force from %s: %d failed logins", i.SourceIP, i.EventCount)
+	i.SetMetadata("usernames", sortedKeys(src.users))
+	i.SetMetadata("window_minutes", int(d.window.Minutes()))
+}
+
+func usersFromMetadata(i *types.SecurityIncident) map[string]bool {
+	users := make(map[string]bool)
+	list, _ := i.Metadata["usernames"].([]interface{})
+	for _, u := range list {
+		if s, ok := u.(string); ok {
+			users[s] = true
+		}
+	}
+	return users
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,219 @@
+package detector
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/internal/monitor"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// maxTrackedPorts caps the ports recorded per incident.
+const maxTrackedPorts = 1000
+
+// PortScan flags a source that hits more than threshold distinct
+// destination ports within the window, based on firewall packet logs. Like
+// BruteForce, it measures the window and the quiet period in log time.
+type PortScan struct {
+	serverID  string
+	threshold int
+	window    time.Duration
+	quiet     time.Duration
+	sources   map[string]*portScanSource
+	clock     monitor.LogClock
+	updated   map[int64]*types.SecurityIncident
+}
+
+type portScanSource struct {
+	ports    map[int]time.Time
+	probed   map[int]bool
+	lastSeen time.Time
+	incident *types.SecurityIncident
+}
+
+func NewPortScan(serverID string, cfg types.PortScanConfig) *PortScan {
+	d := &PortScan{
+		serverID:  serverID,
+		threshold: cfg.Threshold,
+		window:    time.Duration(cfg.WindowSeconds) * time.Second,
+		quiet:     time.Duration(cfg.QuietSeconds) * time.Second,
+		sources:   make(map[string]*portScanSource),
+		updated:   make(map[int64]*types.SecurityIncident),
+	}
+	if d.threshold <= 0 {
+		d.threshold = 10
+	}
+	if d.window <= 0 {
+		d.window = 5 * time.Second
+	}
+	if d.quiet < d.window {
+		d.quiet = d.window
+	}
+
+	open, err := db.OpenIncidents(types.IncidentPortScan)
+	if err != nil {
+		log.Printf("Failed to load open port scan incidents: %v", err)
+	}
+	for _, i := range open {
+		d.sources[i.SourceIP] = &portScanSource{
+			ports:    make(map[int]time.Time),
+			probed:   portsFromMetadata(i),
+			lastSeen: i.EndTime,
+			incident: i,
+		}
+		d.clock.Advance(i.EndTime)
+	}
+	return d
+}
+
+func (d *PortScan) Observe(e *types.Event) []*types.Event {
+	if !isFirewallEvent(e.EventType) || e.SourceIP == "" {
+		return nil
+	}
+	port, ok := e.GetMetadata("dst_port").(int)
+	if !ok || port <= 0 {
+		return nil
+	}
+	d.clock.Advance(e.Timestamp)
+
+	src, ok := d.sources[e.SourceIP]
+	if !ok {
+		src = &portScanSource{ports: make(map[int]time.Time), probed: make(map[int]bool)}
+		d.sources[e.SourceIP] = src
+	}
+
+	src.ports[port] = e.Timestamp
+	cutoff := e.Timestamp.Add(-d.window)
+	for p, seen := range src.ports {
+		if seen.Before(cutoff) {
+			delete(src.ports, p)
+		}
+	}
+	if e.Timestamp.After(src.lastSeen) {
+		src.lastSeen = e.Timestamp
+	}
+
+	if src.incident != nil {
+		if len(src.probed) < maxTrackedPorts {
+			src.probed[port] = true
+		}
+		src.incident.EventCount++
+		if e.Timestamp.After(src.incident.EndTime) {
+			src.incident.EndTime = e.Timestamp
+		}
+		d.describe(src)
+		d.updated[src.incident.ID] = src.incident
+		return nil
+	}
+
+	if len(src.ports) <= d.threshold {
+		return nil
+	}
+
+	start := e.Timestamp
+	for p, seen := range src.ports {
+		src.probed[p] = true
+		if seen.Before(start) {
+			start = seen
+		}
+	}
+	src.incident = &types.SecurityIncident{
+		IncidentType: types.IncidentPortScan,
+		Severity:     types.SeverityWarning,
+		SourceIP:     e.SourceIP,
+		StartTime:    start,
+		EndTime:      e.Timestamp,
+		EventCount:   len(src.ports),
+	}
+	d.describe(src)
+	if err := db.InsertIncident(src.incident); err != nil {
+		// Without an id it could never be updated; the next event from
+		// the source opens it again.
+		log.Printf("Failed to create incident: %v", err)
+		src.incident = nil
+		return nil
+	}
+
+	return []*types.Event{{
+		Timestamp: e.Timestamp,
+		ServerID:  d.serverID,
+		EventType: types.EventPortScanSuspected,
+		Severity:  types.SeverityWarning,
+		SourceIP:  e.SourceIP,
+		DestIP:    e.DestIP,
+		Message:   src.incident.Description,
+		Metadata: map[string]interface{}{
+			"incident_id":    src.incident.ID,
+			"ports":          sortedPorts(src.probed),
+			"window_seconds": int(d.window.Seconds()),
+		},
+	}}
+}
+
+func (d *PortScan) Tick(now time.Time) []*types.Event {
+	now = d.clock.Now(now)
+	if now.IsZero() {
+		return nil
+	}
+	for ip, src := range d.sources {
+		if src.incident == nil {
+			if now.Sub(src.lastSeen) > d.window {
+				delete(d.sources, ip)
+			}
+			continue
+		}
+		if now.Sub(src.lastSeen) < d.quiet {
+			continue
+		}
+		src.incident.Resolved = true
+		d.updated[src.incident.ID] = src.incident
+		delete(d.sources, ip)
+	}
+	return nil
+}
+
+func (d *PortScan) UpdatedIncidents() []*types.SecurityIncident {
+	if len(d.updated) == 0 {
+		return nil
+	}
+	incidents := make([]*types.SecurityIncident, 0, len(d.updated))
+	for _, i := range d.updated {
+		incidents = append(incidents, i)
+	}
+	d.updated = make(map[int64]*types.SecurityIncident)
+	return incidents
+}
+
+func (d *PortScan) describe(src *portScanSource) {
+	i := src.incident
+	i.Description = fmt.Sprintf("Port scan from %s: %d distinct ports probed", i.SourceIP, len(src.probed))
+	i.SetMetadata("ports", sortedPorts(src.probed))
+	i.SetMetadata("window_seconds", int(d.window.Seconds()))
+}
+
+func isFirewallEvent(t types.EventType) bool {
+	return t == types.EventFirewallBlock || t == types.EventFirewallAllow || t == types.EventFirewallLog
+}
+
+func portsFromMetadata(i *types.SecurityIncident) map[int]bool {
+	ports := make(map[int]bool)
+	list, _ := i.Metadata["ports"].([]interface{})
+	for _, p := range list {
+		if f, ok := p.(float64); ok {
+			ports[int(f)] = true
+		}
+	}
+	return ports
+}
+
+func sortedPorts(m map[int]bool) []int {
+	ports := make([]int, 0, len(m))
+	for p := range m {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	return ports
+}
@@ -0,0 +1,153 @@
+// Package errorgroup groups the error events of the web servers and PM2
+// apps by fingerprint, so that one error recurring thousands of times is
+// counted as one group rather than drowning out the others.
+package errorgroup
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/SdxShadow/Mlog/internal/parser/timestamp"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// maxSignature caps the length of a signature; what follows rarely tells
+// errors apart.
+const maxSignature = 500
+
+// Normalisers, applied in order: each one's placeholder must not be
+// matched by the ones after it. A normaliser with a func replaces what its
+// pattern matches only where the func says so.
+var normalisers = []struct {
+	re   *regexp.Regexp
+	repl string
+	fn   func(msg string, match []int) bool
+}{
+	{re: regexp.MustCompile(`\d{4}[-/]\d{2}[-/]\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?: ?(?:Z|[+-]\d{2}:?\d{2}))?`), repl: "<time>"},
+	{re: regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`), repl: "<uuid>"},
+	// A time of day, as in "at 12:30:45", but not the end of an IPv6
+	// address.
+	{re: regexp.MustCompile(`(^|[^\w:])\d{1,2}:\d{2}:\d{2}(?:[.,]\d+)?\b`), repl: "$1<time>"},
+	// IPv6 and IPv4 addresses, with the port if any. IPv6 goes first for
+	// the IPv4-mapped ones such as ::ffff:192.0.2.1.
+	{re: regexp.MustCompile(`\[([0-9a-fA-F:.]+)(?:%[\w.]+)?\](?::\d+)?|((?:[0-9a-fA-F]{0,4}:){1,7}(?:\d{1,3}(?:\.\d{1,3}){3}|[0-9a-fA-F]{1,4}|:))(?:%[\w.]+)?`), repl: "<ip>", fn: isIPv6},
+	{re: regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}(?::\d+)?\b`), repl: "<ip>"},
+	// The path of a URL; the scheme and host are kept.
+	{re: regexp.MustCompile(`(\b[a-z][a-z0-9+.-]*://[^/\s"',]+)/[^\s"',)]*`), repl: "$1<path>"},
+	{re: regexp.MustCompile(`(^|[\s"'(=\[])/[^\s"',()\]]*`), repl: "$1<path>"},
+	// Numbers not part of a word, so error codes such as AH01071 stay.
+	{re: regexp.MustCompile(`\b\d+(?:\.\d+)?\b`), repl: "<n>"},
+	// Addresses, digests and ids; shorter runs of a-f are likely words.
+	{re: regexp.MustCompile(`\b0x[0-9a-fA-F]+\b|\b[0-9a-fA-F]{8,}\b`), repl: "<hex>"},
+	{re: regexp.MustCompile(`\s+`), repl: " "},
+}
+
+// isIPv6 tells an IPv6 address matched by its normaliser from a time, a
+// C++ scope such as Foo::Bar and the like: it has to stand on its own,
+// parse, and have a hex letter or a "::" in it.
+func isIPv6(msg string, m []int) bool {
+	if m[2] >= 0 {
+		return validIPv6(msg[m[2]:m[3]])
+	}
+	start, end := m[0], m[1]
+	if start > 0 && isWordByte(msg[start-1]) || end < len(msg) && isWordByte(msg[end]) {
+		return false
+	}
+	return validIPv6(msg[m[4]:m[5]])
+}
+
+func validIPv6(addr string) bool {
+	if net.ParseIP(addr) == nil || !strings.Contains(addr, ":") {
+		return false
+	}
+	return strings.Contains(addr, "::") || strings.ContainsAny(addr, "abcdefABCDEF")
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// replace applies a normaliser with a func, leaving the matches it
+// rejects as they are.
+func replace(msg string, re *regexp.Regexp, repl string, fn func(string, []int) bool) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(msg, -1) {
+		if !fn(msg, m) {
+			continue
+		}
+		b.WriteString(msg[last:m[0]])
+		b.WriteString(repl)
+		last = m[1]
+	}
+	if last == 0 {
+		return msg
+	}
+	b.WriteString(msg[last:])
+	return b.String()
+}
+
+// frameLine is the line and column at the end of a stack frame, as in
+// getUser (/app/src/users.js:12:15).
+var frameLine = regexp.MustCompile(`:\d+(?::\d+)?(\)?)$`)
+
+// Normalize replaces the parts of a message that vary between occurrences
+// of the same error, such as addresses, ports, PIDs, paths, numbers and hex
+// ids, with placeholders:
+//
+//	*4711 connect() failed (111: Connection refused) while connecting to upstream, client: 203.0.113.9, upstream: "http://127.0.0.1:3000/api/users/42"
+//	*<n> connect() failed (<n>: Connection refused) while connecting to upstream, client: <ip>, upstream: "http://<ip><path>"
+func Normalize(msg string) string {
+	for _, n := range normalisers {
+		if n.fn != nil {
+			msg = replace(msg, n.re, n.repl, n.fn)
+			continue
+		}
+		msg = n.re.ReplaceAllString(msg, n.repl)
+	}
+	msg = strings.TrimSpace(msg)
+	if len(msg) > maxSignature {
+		msg = msg[:maxSignature]
+	}
+	return msg
+}
+
+// Signature is what the errors of a group have in common. For a PM2 stack
+// trace it is, as Sentry does it, the error class and the frame that
+// raised it, since the message often carries values; for other errors it
+// is the normalised message.
+func Signature(e *types.Event) string {
+	if e.EventType == types.EventPM2Error {
+		class, _ := e.GetMetadata("error_class").(string)
+		frame, _ := e.GetMetadata("top_frame").(string)
+		if class != "" && frame != "" {
+			// The file is kept, only the line and column vary.
+			return class + " at " + frameLine.ReplaceAllString(frame, "$1")
+		}
+		if class != "" {
+			msg, _ := e.GetMetadata("error_message").(string)
+			return Normalize(class + ": " + msg)
+		}
+		// The event message says nothing; the line does.
+		line, _, _ := strings.Cut(e.RawLog, "\n")
+		_, line, _ = timestamp.PM2Prefix(line)
+		return Normalize(line)
+	}
+	return Normalize(e.Message)
+}
+
+// Source is what an error group is kept per besides its event type: the
+// app, for PM2.
+func Source(e *types.Event) string {
+	app, _ := e.GetMetadata("app").(string)
+	return app
+}
+
+// Fingerprint identifies the group of an error.
+func Fingerprint(eventType types.EventType, source, signature string) string {
+	sum := sha1.Sum([]byte(string(eventType) + "\x00" + source + "\x00" + signature))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,139 @@
+package errorgroup
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// maxSample caps the sample kept of an error, enough for a stack trace.
+const maxSample = 4096
+
+// Grouped is whether errors of an event type are grouped.
+func Grouped(t types.EventType) bool {
+	switch t {
+	case types.EventNginxError, types.EventApacheError, types.EventPM2Error:
+		return true
+	}
+	return false
+}
+
+// Grouper counts the nginx, Apache and PM2 error events into error_groups,
+// and raises an ERROR_GROUP_NEW event the first time a fingerprint is seen.
+// Counts are written on each tick rather than per event, so a flood of one
+// error costs one update.
+type Grouper struct {
+	serverID string
+	known    map[string]bool
+	pending  map[string]*types.ErrorGroup
+}
+
+// NewGrouper loads the fingerprints already stored, so that groups seen
+// before a restart are not reported as new again.
+func NewGrouper(serverID string) *Grouper {
+	g := &Grouper{serverID: serverID, pending: make(map[string]*types.ErrorGroup)}
+	known, err := db.ErrorFingerprints()
+	if err != nil {
+		log.Printf("Failed to load error groups: %v", err)
+		known = make(map[string]bool)
+	}
+	g.known = known
+	return g
+}
+
+func (g *Grouper) Observe(e *types.Event) []*types.Event {
+	if !Grouped(e.EventType) {
+		return nil
+	}
+	sig := Signature(e)
+	if sig == "" {
+		return nil
+	}
+	source := Source(e)
+	fp := Fingerprint(e.EventType, source, sig)
+
+	sample := e.RawLog
+	if len(sample) > maxSample {
+		sample = sample[:maxSample]
+	}
+	p := g.pending[fp]
+	if p == nil {
+		p = &types.ErrorGroup{
+			Fingerprint: fp,
+			EventType:   e.EventType,
+			Source:      source,
+			Signature:   sig,
+			FirstSeen:   e.Timestamp,
+		}
+		g.pending[fp] = p
+	}
+	p.Count++
+	if e.Timestamp.Before(p.FirstSeen) {
+		p.FirstSeen = e.Timestamp
+	}
+	if !e.Timestamp.Before(p.LastSeen) {
+		p.LastSeen = e.Timestamp
+		p.Sample = sample
+	}
+
+	if g.known[fp] {
+		return nil
+	}
+	g.known[fp] = true
+	return []*types.Event{g.newGroup(e, p)}
+}
+
+func (g *Grouper) newGroup(e *types.Event, p *types.ErrorGroup) *types.Event {
+	event := &types.Event{
+		Timestamp: e.Timestamp,
+		ServerID:  g.serverID,
+		EventType: types.EventErrorGroupNew,
+		Severity:  e.Severity,
+		Message:   "New error: " + p.Signature,
+		RawLog:    e.RawLog,
+	}
+	event.SetMetadata("fingerprint", p.Fingerprint)
+	event.SetMetadata("error_type", string(p.EventType))
+	event.SetMetadata("signature", p.Signature)
+	if p.Source != "" {
+		event.SetMetadata("source", p.Source)
+	}
+	return event
+}
+
+func (g *Grouper) Tick(now time.Time) []*types.Event {
+	g.write()
+	return nil
+}
+
+func (g *Grouper) Flush() {
+	g.write()
+}
+
+func (g *Grouper) write() {
+	if len(g.pending) == 0 {
+		return
+	}
+	groups := make([]*types.ErrorGroup, 0, len(g.pending))
+	for _, p := range g.pending {
+		groups = append(groups, p)
+	}
+	if err := db.SaveErrorGroups(groups); err != nil {
+		log.Printf("Failed to record error groups: %v", err)
+	}
+	g.pending = make(map[string]*types.ErrorGroup)
+}
+
+// Score ranks a group by frequency and recency: its count, halved for
+// every day since it was last seen. An error that stopped a week ago
+// ranks below a smaller one still happening.
+func Score(grp *types.ErrorGroup, now time.Time) float64 {
+	days := now.Sub(grp.LastSeen).Hours() / 24
+	if days < 0 {
+		days = 0
+	}
+	return float64(grp.Count) * math.Exp2(-days)
+}
@@ -0,0 +1,104 @@
+// Package latency keeps the response time distributions of HTTP routes
+// from the request_time of access log events.
+package latency
+
+import (
+	"math"
+	"sort"
+)
+
+// Response times are counted in bins growing by a quarter of a doubling,
+// from 1ms up to about 17 minutes, so a percentile read from a histogram
+// is within a few percent of the exact one whatever the scale.
+const (
+	binsPerDoubling = 4
+	firstBound      = 0.001 // seconds
+	maxBin          = 80
+)
+
+// bound is the upper bound of bin i, in seconds.
+func bound(i int) float64 {
+	return firstBound * math.Exp2(float64(i)/binsPerDoubling)
+}
+
+func binFor(seconds float64) int {
+	if seconds <= firstBound {
+		return 0
+	}
+	i := int(math.Ceil(math.Log2(seconds/firstBound) * binsPerDoubling))
+	if i > maxBin {
+		return maxBin
+	}
+	return i
+}
+
+// Histogram is a response time distribution.
+type Histogram struct {
+	Count int64
+	Total float64
+	Max   float64
+	Bins  map[int]int64
+}
+
+func (h *Histogram) Add(seconds float64) {
+	if h.Bins == nil {
+		h.Bins = make(map[int]int64)
+	}
+	h.Count++
+	h.Total += seconds
+	if seconds > h.Max {
+		h.Max = seconds
+	}
+	h.Bins[binFor(seconds)]++
+}
+
+func (h *Histogram) Merge(o *Histogram) {
+	if h.Bins == nil {
+		h.Bins = make(map[int]int64)
+	}
+	h.Count += o.Count
+	h.Total += o.Total
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+	for i, n := range o.Bins {
+		h.Bins[i] += n
+	}
+}
+
+// Mean is the average response time, in seconds.
+func (h *Histogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / float64(h.Count)
+}
+
+// Quantile estimates the response time below which the fraction q of the
+// requests fall, interpolating within the bin it lands in.
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	bins := make([]int, 0, len(h.Bins))
+	for i := range h.Bins {
+		bins = append(bins, i)
+	}
+	sort.Ints(bins)
+
+	rank := q * float64(h.Count)
+	var seen float64
+	for _, i := range bins {
+		n := float64(h.Bins[i])
+		if seen+n >= rank {
+			lower := 0.0
+			if i > 0 {
+				lower = bound(i - 1)
+			}
+			v := lower + (bound(i)-lower)*(rank-seen)/n
+			return math.Min(v, h.Max)
+		}
+		seen += n
+	}
+	return h.Max
+}
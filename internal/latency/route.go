@@ -0,0 +1,47 @@
+package latency
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	numberSegment = regexp.MustCompile(`^\d+$`)
+	uuidSegment   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	// Hex digests and object ids: at least 16 hex digits, one of them a
+	// digit so that long words made of a-f are left alone.
+	hashSegment = regexp.MustCompile(`^[0-9a-fA-F]*[0-9][0-9a-fA-F]*$`)
+)
+
+// Route templates the path of a URI so that requests for different
+// records of the same endpoint are counted together:
+// /api/users/42/orders?page=2 becomes /api/users/:id/orders. Numeric ids,
+// UUIDs and hex hashes are replaced, also within a file name, as in
+// /invoices/:id.pdf. It returns "" for a URI that is not a path, such as
+// the garbage of a TLS handshake sent to a plain HTTP port.
+func Route(uri string) string {
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		uri = uri[:i]
+	}
+	if !strings.HasPrefix(uri, "/") {
+		return ""
+	}
+
+	segments := strings.Split(uri, "/")
+	for i, seg := range segments {
+		// Ids are also found between dots, as in app.3f9a8c1b2d4e5f60.js.
+		parts := strings.Split(seg, ".")
+		for j, part := range parts {
+			switch {
+			case numberSegment.MatchString(part):
+				parts[j] = ":id"
+			case uuidSegment.MatchString(part):
+				parts[j] = ":uuid"
+			case len(part) >= 16 && hashSegment.MatchString(part):
+				parts[j] = ":hash"
+			}
+		}
+		segments[i] = strings.Join(parts, ".")
+	}
+	return strings.Join(segments, "/")
+}
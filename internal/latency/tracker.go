@@ -0,0 +1,206 @@
+package latency
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/internal/monitor"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// OtherRoute counts the requests of the routes beyond the limit of a
+// minute, which are mostly scanners probing random paths.
+const OtherRoute = "(other)"
+
+type routeKey struct {
+	host, method, route string
+}
+
+type routeStats struct {
+	Histogram
+	upstreamCount int64
+	upstreamTotal float64
+}
+
+// Tracker builds a histogram of the request times of each host, method
+// and route per minute from the access log events, and writes out the
+// minutes that are over into http_latency. Requests without a
+// request_time are counted by their upstream_response_time.
+type Tracker struct {
+	maxRoutes int
+	minutes   map[time.Time]map[routeKey]*routeStats
+	clock     monitor.LogClock
+}
+
+// NewTracker keeps at most maxRoutes routes per minute; the requests of
+// any others are counted under OtherRoute.
+func NewTracker(maxRoutes int) *Tracker {
+	return &Tracker{maxRoutes: maxRoutes, minutes: make(map[time.Time]map[routeKey]*routeStats)}
+}
+
+func (t *Tracker) Observe(e *types.Event) []*types.Event {
+	if !isRequest(e.EventType) {
+		return nil
+	}
+	rt, ok := e.GetMetadata("request_time").(float64)
+	upstream, hasUpstream := e.GetMetadata("upstream_response_time").(float64)
+	if !ok {
+		if !hasUpstream {
+			return nil
+		}
+		rt = upstream
+	}
+	uri, _ := e.GetMetadata("uri").(string)
+	route := Route(uri)
+	if route == "" {
+		return nil
+	}
+	key := routeKey{route: route}
+	key.host, _ = e.GetMetadata("host").(string)
+	key.method, _ = e.GetMetadata("method").(string)
+
+	t.clock.Advance(e.Timestamp)
+	minute := e.Timestamp.Truncate(time.Minute)
+	routes := t.minutes[minute]
+	if routes == nil {
+		routes = make(map[routeKey]*routeStats)
+		t.minutes[minute] = routes
+	}
+	s := routes[key]
+	if s == nil {
+		if t.maxRoutes > 0 && len(routes) >= t.maxRoutes {
+			key.route = OtherRoute
+			s = routes[key]
+		}
+		if s == nil {
+			s = &routeStats{}
+			routes[key] = s
+		}
+	}
+	s.Add(rt)
+	if hasUpstream {
+		s.upstreamCount++
+		s.upstreamTotal += upstream
+	}
+	return nil
+}
+
+// Tick writes out the minutes before the current one in log time, so that
+// a backlog is written a minute at a time rather than in as many partial
+// rows as there are ticks. Lines of a minute that arrive late, as from a
+// log read after another, are written as another row for the same minute.
+func (t *Tracker) Tick(now time.Time) []*types.Event {
+	now = t.clock.Now(now)
+	if now.IsZero() {
+		return nil
+	}
+	t.write(now.Truncate(time.Minute))
+	return nil
+}
+
+// Flush writes out every minute, including the current one, when the
+// watcher stops.
+func (t *Tracker) Flush() {
+	t.write(time.Time{})
+}
+
+// write stores the minutes before until, or all of them when until is
+// zero.
+func (t *Tracker) write(until time.Time) {
+	var rows []*db.LatencyRow
+	for minute, routes := range t.minutes {
+		if !until.IsZero() && !minute.Before(until) {
+			continue
+		}
+		for key, s := range routes {
+			rows = append(rows, &db.LatencyRow{
+				Minute:        minute,
+				Host:          key.host,
+				Method:        key.method,
+				Route:         key.route,
+				Count:         s.Count,
+				Total:         s.Total,
+				Max:           s.Max,
+				UpstreamCount: s.upstreamCount,
+				UpstreamTotal: s.upstreamTotal,
+				Bins:          s.Bins,
+			})
+		}
+		delete(t.minutes, minute)
+	}
+	if len(rows) == 0 {
+		return
+	}
+	if err := db.InsertLatency(rows); err != nil {
+		log.Printf("Failed to record HTTP latency: %v", err)
+	}
+}
+
+func isRequest(t types.EventType) bool {
+	for _, r := range types.HTTPRequestEvents {
+		if t == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Stat is the latency of a host, or of a method and route of a host, over
+// a window.
+type Stat struct {
+	Host   string
+	Method string
+	Route  string
+	Histogram
+	UpstreamCount int64
+	UpstreamTotal float64
+}
+
+// UpstreamMean is the average time spent waiting for the upstream, in
+// seconds, over the requests that were proxied.
+func (s *Stat) UpstreamMean() float64 {
+	if s.UpstreamCount == 0 {
+		return 0
+	}
+	return s.UpstreamTotal / float64(s.UpstreamCount)
+}
+
+// Summarize adds up the stored minutes from since on, per host or, with
+// byRoute, per host, method and route. host limits it to one host. The
+// result is ordered by request count, busiest first.
+func Summarize(since time.Time, host string, byRoute bool) ([]*Stat, error) {
+	rows, err := db.LatencyRows(since, host)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[routeKey]*Stat)
+	for _, r := range rows {
+		key := routeKey{host: r.Host}
+		if byRoute {
+			key.method, key.route = r.Method, r.Route
+		}
+		s := stats[key]
+		if s == nil {
+			s = &Stat{Host: key.host, Method: key.method, Route: key.route}
+			stats[key] = s
+		}
+		s.Merge(&Histogram{Count: r.Count, Total: r.Total, Max: r.Max, Bins: r.Bins})
+		s.UpstreamCount += r.UpstreamCount
+		s.UpstreamTotal += r.UpstreamTotal
+	}
+
+	result := make([]*Stat, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Host+result[i].Route < result[j].Host+result[j].Route
+	})
+	return result, nil
+}
@@ -0,0 +1,370 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/internal/parser"
+	"github.com/SdxShadow/Mlog/internal/parser/timestamp"
+)
+
+// journalCursorKey is where the cursor of the last stored journal entry is
+// kept in the config table.
+const journalCursorKey = "journal_cursor"
+
+// journalRestartDelay is how long to wait before restarting journalctl
+// after it failed.
+const journalRestartDelay = 5 * time.Second
+
+// maxFieldSize caps a binary field of the export format. journald itself
+// truncates messages well below it; a larger size means the stream is
+// corrupt.
+const maxFieldSize = 4 << 20
+
+// JournalParsers maps a SYSLOG_IDENTIFIER, or a _SYSTEMD_UNIT, to the
+// parsers for its messages.
+var JournalParsers = map[string][]string{
+	"sshd":         {"ssh"},
+	"ssh.service":  {"ssh"},
+	"sshd.service": {"ssh"},
+	"sudo":         {"auth"},
+	"su":           {"auth"},
+	"useradd":      {"auth"},
+	"userdel":      {"auth"},
+	"usermod":      {"auth"},
+	"groupadd":     {"auth"},
+	"groupdel":     {"auth"},
+	"groupmod":     {"auth"},
+	"gpasswd":      {"auth"},
+	"passwd":       {"auth"},
+	"chpasswd":     {"auth"},
+	"chage":        {"auth"},
+	"kernel":       {"kernel", "firewall"},
+	"systemd":      {"systemd"},
+}
+
+// JournalOptions configures the journal source.
+type JournalOptions struct {
+	// Command is the journalctl binary. A script replaying recorded
+	// `journalctl -o export` output works as well.
+	Command string
+	// Parsers adds to or overrides JournalParsers.
+	Parsers map[string][]string
+}
+
+// journalSource follows the systemd journal through `journalctl -o export
+// -f`. Entries are turned back into syslog lines so the existing parsers
+// can read them, and the journal cursor is stored with the events.
+type journalSource struct {
+	w       *Watcher
+	command string
+	parsers map[string]parser.Parser
+
+	// cursor is the cursor of the last entry read, which journalctl is
+	// restarted after.
+	cursor string
+	// skipCursor is set when journalctl failed on the stored cursor, e.g.
+	// because the journal was vacuumed past it.
+	skipCursor bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// AddJournal reads the journal for the identifiers and units whose parser
+// is not already fed by a log file, so that systems without rsyslog are
+// still covered and systems with it do not see every line twice. It must
+// be called after the log files have been added.
+func (w *Watcher) AddJournal(opts JournalOptions) error {
+	names := make(map[string][]string)
+	for k, v := range JournalParsers {
+		names[k] = v
+	}
+	for k, v := range opts.Parsers {
+		names[k] = v
+	}
+
+	parsers := make(map[string]parser.Parser)
+	for key, list := range names {
+		var unfed []string
+		for _, name := range list {
+			if !w.fed[name] {
+				unfed = append(unfed, name)
+			}
+		}
+		if len(unfed) == 0 {
+			continue
+		}
+		p, err := w.parser(unfed)
+		if err != nil {
+			return fmt.Errorf("journal %s: %w", key, err)
+		}
+		parsers[key] = p
+	}
+	if len(parsers) == 0 {
+		log.Printf("All journal parsers are fed by log files; not reading the journal")
+		return nil
+	}
+
+	command := opts.Command
+	if command == "" {
+		command = "journalctl"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.journal = &journalSource{
+		w:       w,
+		command: command,
+		parsers: parsers,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	return nil
+}
+
+// catchUp reads the entries logged after the stored cursor while mlog was
+// down, and returns once journalctl has reached the end of the journal.
+// Without a stored cursor there is nothing to catch up on. A failure is
+// only logged; run tries again.
+func (j *journalSource) catchUp() {
+	n, usedCursor, err := j.read(false)
+	if err != nil {
+		log.Printf("Journal catch-up failed: %v", err)
+		return
+	}
+	if usedCursor && n > 0 {
+		log.Printf("Caught up on %d journal entries", n)
+	}
+}
+
+func (j *journalSource) start() {
+	go j.run()
+}
+
+func (j *journalSource) stop() {
+	j.cancel()
+	<-j.done
+}
+
+// run keeps journalctl running. A clean exit means the input ended, which
+// only happens with a replay script; a failure is retried after a delay.
+func (j *journalSource) run() {
+	defer close(j.done)
+
+	for {
+		n, usedCursor, err := j.read(true)
+		if j.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			log.Printf("journalctl exited")
+			return
+		}
+		if n == 0 && usedCursor {
+			log.Printf("Journal error: %v; discarding the stored cursor", err)
+			j.skipCursor = true
+		} else {
+			log.Printf("Journal error: %v; restarting in %s", err, journalRestartDelay)
+		}
+		select {
+		case <-j.ctx.Done():
+			return
+		case <-time.After(journalRestartDelay):
+		}
+	}
+}
+
+// args builds the journalctl command line: continue after the last entry
+// read or the stored cursor, or start at the end like a log file without
+// a checkpoint, and only ask for the identifiers and units there is a
+// parser for. Unless follow is set, journalctl exits at the end of the
+// journal.
+func (j *journalSource) args(follow bool) ([]string, bool, error) {
+	cursor := j.cursor
+	if cursor == "" {
+		var err error
+		if cursor, _, err = db.GetConfigValue(journalCursorKey); err != nil {
+			return nil, false, err
+		}
+	}
+	if j.skipCursor {
+		cursor = ""
+	}
+
+	args := []string{"-o", "export", "--no-pager"}
+	if follow {
+		args = append(args, "-f")
+	}
+	if cursor != "" {
+		args = append(args, "--after-cursor="+cursor)
+	} else {
+		args = append(args, "--lines=0")
+	}
+
+	var idents, units []string
+	for key := range j.parsers {
+		if strings.Contains(key, ".") {
+			units = append(units, "_SYSTEMD_UNIT="+key)
+		} else {
+			idents = append(idents, "SYSLOG_IDENTIFIER="+key)
+		}
+	}
+	sort.Strings(idents)
+	sort.Strings(units)
+	// Matches on the same field are ORed; "+" ORs the two groups.
+	args = append(args, idents...)
+	if len(idents) > 0 && len(units) > 0 {
+		args = append(args, "+")
+	}
+	return append(args, units...), cursor != "", nil
+}
+
+// read runs journalctl until it exits and returns the number of entries
+// read and whether it was started from a cursor.
+func (j *journalSource) read(follow bool) (int, bool, error) {
+	args, usedCursor, err := j.args(follow)
+	if err != nil {
+		return 0, false, err
+	}
+	if !follow && !usedCursor {
+		return 0, false, nil
+	}
+
+	ctx, cancel := context.WithCancel(j.ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, j.command, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, usedCursor, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, usedCursor, err
+	}
+
+	n := 0
+	readErr := readExport(bufio.NewReader(stdout), func(fields map[string]string) {
+		n++
+		j.handle(fields)
+	})
+	if readErr != nil {
+		// journalctl would otherwise wait forever to write the rest, or
+		// with -f for new entries.
+		cancel()
+		io.Copy(io.Discard, stdout)
+		cmd.Wait()
+		return n, usedCursor, readErr
+	}
+	waitErr := cmd.Wait()
+	if n > 0 {
+		j.skipCursor = false
+	}
+	return n, usedCursor, waitErr
+}
+
+// handle parses one journal entry and queues its event and cursor.
+func (j *journalSource) handle(fields map[string]string) {
+	p := j.parsers[fields["SYSLOG_IDENTIFIER"]]
+	if p == nil {
+		p = j.parsers[fields["_SYSTEMD_UNIT"]]
+	}
+	msg := fields["MESSAGE"]
+	if p != nil && msg != "" {
+		ts := time.Now()
+		if usec, err := strconv.ParseInt(fields["__REALTIME_TIMESTAMP"], 10, 64); err == nil {
+			ts = time.UnixMicro(usec)
+		}
+		for _, line := range strings.Split(msg, "\n") {
+			if event := p.Parse(syslogLine(fields, line, ts), ts); event != nil {
+				// The syslog header only has second precision.
+				event.Timestamp = ts
+				event.SetMetadata("source", "journal")
+				j.w.emit(event)
+			}
+		}
+	}
+	if cursor := fields["__CURSOR"]; cursor != "" {
+		j.cursor = cursor
+		j.w.pipe.pushState(journalCursorKey, cursor)
+	}
+}
+
+// syslogLine renders a journal entry the way rsyslog would have written
+// it to auth.log, e.g. "Oct 11 22:14:15 host sshd[123]: message".
+func syslogLine(fields map[string]string, msg string, ts time.Time) string {
+	ident := fields["SYSLOG_IDENTIFIER"]
+	if ident == "" {
+		ident = strings.TrimSuffix(fields["_SYSTEMD_UNIT"], ".service")
+	}
+	pid := fields["SYSLOG_PID"]
+	if pid == "" {
+		pid = fields["_PID"]
+	}
+	host := fields["_HOSTNAME"]
+	if host == "" {
+		host = "localhost"
+	}
+
+	tag := ident
+	if pid != "" {
+		tag += "[" + pid + "]"
+	}
+	return ts.In(timestamp.Location()).Format(time.Stamp) + " " + host + " " + tag + ": " + msg
+}
+
+// readExport reads the journal export format: one KEY=value line per
+// field and a blank line after each entry. Fields that are not plain text
+// are written as the key alone, followed by a little-endian 64-bit length,
+// the raw data and a newline.
+func readExport(r *bufio.Reader, fn func(map[string]string)) error {
+	fields := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			if len(fields) > 0 {
+				fn(fields)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "" {
+			if len(fields) > 0 {
+				fn(fields)
+				fields = make(map[string]string)
+			}
+			continue
+		}
+
+		if key, value, ok := strings.Cut(line, "="); ok {
+			fields[key] = value
+			continue
+		}
+
+		var size uint64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return fmt.Errorf("reading size of %s: %w", line, err)
+		}
+		if size > maxFieldSize {
+			return fmt.Errorf("%s is %d bytes, more than %d", line, size, maxFieldSize)
+		}
+		data := make([]byte, size+1) // trailing newline
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("reading %s: %w", line, err)
+		}
+		fields[line] = string(data[:size])
+	}
+}
@@ -0,0 +1,202 @@
+package monitor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/internal/parser"
+)
+
+// kmsgPositionKey is where the boot id and sequence number of the last
+// stored kernel record are kept in the config table.
+const kmsgPositionKey = "kmsg_position"
+
+// kmsgParsers read the kernel ring buffer.
+var kmsgParsers = []string{"kernel", "firewall"}
+
+// kmsgSource reads the kernel ring buffer from /dev/kmsg, for systems where
+// no syslog daemon writes kern.log. Each record is
+//
+//	<priority>,<sequence>,<microseconds since boot>,<flags>;<message>
+//
+// optionally followed by " KEY=value" lines, which are skipped.
+type kmsgSource struct {
+	w      *Watcher
+	path   string
+	host   string
+	parser parser.Parser
+	f      *os.File
+
+	bootID string
+	// boot is when the system booted, to date records by.
+	boot time.Time
+	// after is the last sequence number already stored for this boot.
+	after int64
+
+	done chan struct{}
+}
+
+// AddKmsg reads the kernel ring buffer at path, normally /dev/kmsg, with
+// the parsers that are not already fed by a log file. It continues after
+// the last stored record when the system has not rebooted since, reads the
+// whole buffer after a reboot, and otherwise starts at the end.
+func (w *Watcher) AddKmsg(path string) error {
+	var names []string
+	for _, name := range kmsgParsers {
+		if !w.fed[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	p, err := w.parser(names)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	k := &kmsgSource{
+		w:      w,
+		path:   path,
+		host:   hostname(),
+		parser: p,
+		f:      f,
+		bootID: readBootID(),
+		boot:   bootTime(),
+		after:  -1,
+		done:   make(chan struct{}),
+	}
+
+	saved, _, err := db.GetConfigValue(kmsgPositionKey)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	bootID, seq, _ := strings.Cut(saved, ":")
+	switch {
+	case saved == "":
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case bootID == k.bootID:
+		k.after, _ = strconv.ParseInt(seq, 10, 64)
+	}
+
+	w.kmsg = k
+	for _, name := range names {
+		w.fed[name] = true
+	}
+	return nil
+}
+
+func (k *kmsgSource) start() {
+	go k.run()
+}
+
+// stop closes the device, which ends the blocked read.
+func (k *kmsgSource) stop() {
+	k.f.Close()
+	<-k.done
+}
+
+func (k *kmsgSource) run() {
+	defer close(k.done)
+
+	r := bufio.NewReaderSize(k.f, 16*1024)
+	for {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, syscall.EPIPE) {
+			// Records were overwritten before they were read.
+			log.Printf("%s: kernel messages lost, the ring buffer wrapped", k.path)
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+				log.Printf("%s: %v", k.path, err)
+			}
+			return
+		}
+		k.handle(strings.TrimSuffix(line, "\n"))
+	}
+}
+
+// handle parses one record and queues its event and position.
+func (k *kmsgSource) handle(record string) {
+	if strings.HasPrefix(record, " ") {
+		return // a KEY=value continuation line
+	}
+	header, msg, ok := strings.Cut(record, ";")
+	if !ok {
+		return
+	}
+	fields := strings.Split(header, ",")
+	if len(fields) < 3 {
+		return
+	}
+	seq, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || seq <= k.after {
+		return
+	}
+	k.after = seq
+
+	ts := time.Now()
+	if usec, err := strconv.ParseInt(fields[2], 10, 64); err == nil && !k.boot.IsZero() {
+		ts = k.boot.Add(time.Duration(usec) * time.Microsecond)
+	}
+
+	line := syslogLine(map[string]string{"SYSLOG_IDENTIFIER": "kernel", "_HOSTNAME": k.host}, msg, ts)
+	if event := k.parser.Parse(line, ts); event != nil {
+		event.Timestamp = ts
+		event.SetMetadata("source", "kmsg")
+		k.w.emit(event)
+	}
+	k.w.pipe.pushState(kmsgPositionKey, k.bootID+":"+strconv.FormatInt(seq, 10))
+}
+
+// readBootID identifies the current boot; sequence numbers restart with
+// every boot.
+func readBootID() string {
+	data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// bootTime estimates when the system booted from /proc/uptime. Record
+// times are only approximate after a suspend, which the kernel clock used
+// for them does not count.
+func bootTime() time.Time {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return time.Time{}
+	}
+	up, _, _ := strings.Cut(string(data), " ")
+	secs, err := strconv.ParseFloat(up, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Now().Add(-time.Duration(secs * float64(time.Second)))
+}
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return h
+}
@@ -0,0 +1,88 @@
+package monitor
+
+import (
+	"time"
+
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// Observer sees every event after it has been stored and may derive new
+// events from it, as the security detectors do. Observers are called from
+// the writer goroutine only, so they need no locking of their own.
+type Observer interface {
+	Observe(e *types.Event) []*types.Event
+}
+
+// Ticker is implemented by observers that need periodic housekeeping, such
+// as closing incidents once an attack has gone quiet. Now is the wall
+// clock; state kept by event time should be expired against a LogClock.
+type Ticker interface {
+	Tick(now time.Time) []*types.Event
+}
+
+// Resumer is implemented by observers that carry state over from the
+// previous run and have to wait for the lines logged while mlog was down
+// before settling it. CaughtUp is called once those lines have been
+// stored and observed.
+type Resumer interface {
+	CaughtUp() []*types.Event
+}
+
+// IncidentUpdater is implemented by observers that keep security incidents
+// up to date. The incidents changed since the last call are written with
+// the next batch, so that an attack costs one update per batch rather
+// than one per event.
+type IncidentUpdater interface {
+	UpdatedIncidents() []*types.SecurityIncident
+}
+
+// LogClock tells the time by the events an observer has seen. While a
+// backlog is read the wall clock runs ahead of the events, and expiring
+// state against it would drop what is still being read. A LogClock keeps
+// the newest event time instead, and only moves on with the wall clock
+// while no newer events arrive.
+type LogClock struct {
+	latest time.Time
+	seenAt time.Time
+}
+
+// Advance records the time of an event.
+func (c *LogClock) Advance(t time.Time) {
+	if !t.After(c.latest) {
+		return
+	}
+	now := time.Now()
+	if t.After(now) {
+		t = now
+	}
+	c.latest, c.seenAt = t, now
+}
+
+// Now returns the log time at the wall-clock time now, or the zero time
+// before any event has been seen.
+func (c *LogClock) Now(now time.Time) time.Time {
+	if c.latest.IsZero() {
+		return time.Time{}
+	}
+	t := c.latest.Add(now.Sub(c.seenAt))
+	if t.After(now) {
+		return now
+	}
+	return t
+}
+
+// Flusher is implemented by observers that hold data in memory, such as
+// aggregates not yet written, to save when the watcher stops.
+type Flusher interface {
+	Flush()
+}
+
+func (w *Watcher) AddObserver(o Observer) {
+	w.observers = append(w.observers, o)
+}
+
+// emit queues an event for the writer, which stores it and then passes it
+// to the observers.
+func (w *Watcher) emit(event *types.Event) {
+	w.pipe.push(event)
+}
@@ -0,0 +1,359 @@
+package monitor
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// StatsKey is the config table key the pipeline publishes its metrics
+// under, for `mlog pipeline` to read from another process.
+const StatsKey = "pipeline_stats"
+
+// statsInterval is how often the metrics are written to the database.
+const statsInterval = 10 * time.Second
+
+// A batch that fails to write is retried, waiting twice as long each time
+// up to maxRetryDelay. When the watcher stops, it is given up after
+// closeRetries attempts; its checkpoints are not stored either, so its
+// lines are read again on the next start.
+const (
+	firstRetryDelay = 500 * time.Millisecond
+	maxRetryDelay   = 30 * time.Second
+	closeRetries    = 3
+)
+
+// PipelineStats describes the ingestion queue and the batch writer.
+type PipelineStats struct {
+	QueueDepth    int           `json:"queue_depth"`
+	QueueCapacity int           `json:"queue_capacity"`
+	Overflow      string        `json:"overflow"`
+	Enqueued      int64         `json:"enqueued"`
+	Written       int64         `json:"written"`
+	Dropped       int64         `json:"dropped"`
+	Blocked       int64         `json:"blocked"`
+	BlockedTime   time.Duration `json:"blocked_ns"`
+	Failed        int64         `json:"failed"`
+	Batches       int64         `json:"batches"`
+	LastBatch     int           `json:"last_batch"`
+	LastFlush     time.Duration `json:"last_flush_ns"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+}
+
+// pipeline decouples reading logs from writing them. Readers push events
+// and checkpoints into a bounded queue; a single writer stores them in
+// batches, one transaction each, and then runs the observers. Observers
+// and tickers only ever run on the writer goroutine.
+type pipeline struct {
+	queue         chan item
+	batchSize     int
+	flushInterval time.Duration
+	tickInterval  time.Duration
+	drop          bool
+	observers     []Observer
+
+	events      []*types.Event
+	observe     []bool
+	incidents   []*types.SecurityIncident
+	checkpoints map[string]*db.Checkpoint
+	state       map[string]string
+
+	enqueued    atomic.Int64
+	written     atomic.Int64
+	dropped     atomic.Int64
+	blocked     atomic.Int64
+	blockedTime atomic.Int64
+	failed      atomic.Int64
+	batches     atomic.Int64
+	lastBatch   atomic.Int64
+	lastFlush   atomic.Int64
+
+	closing bool
+	done    chan struct{}
+}
+
+// item is either an event read from a log, the checkpoint reached after
+// reading it, the position of a source that is not a file, stored under
+// key in the config table, or the mark that the catch-up on what was
+// logged while mlog was down has been queued.
+type item struct {
+	event      *types.Event
+	cp         *db.Checkpoint
+	key, value string
+	caughtUp   bool
+}
+
+func newPipeline(cfg types.MonitoringConfig, tickInterval time.Duration, observers []Observer) *pipeline {
+	p := &pipeline{
+		batchSize:    cfg.BatchSize,
+		tickInterval: tickInterval,
+		drop:         cfg.Overflow == "drop",
+		observers:    observers,
+		checkpoints:  make(map[string]*db.Checkpoint),
+		state:        make(map[string]string),
+		done:         make(chan struct{}),
+	}
+	size := cfg.BufferSize
+	if size <= 0 {
+		size = 10000
+	}
+	p.queue = make(chan item, size)
+	if p.batchSize <= 0 {
+		p.batchSize = 500
+	}
+	if d, err := time.ParseDuration(cfg.FlushInterval); err == nil && d > 0 {
+		p.flushInterval = d
+	} else {
+		p.flushInterval = 500 * time.Millisecond
+	}
+	return p
+}
+
+// push queues an event read from a log. When the queue is full it either
+// waits for the writer or discards the event, depending on the overflow
+// policy.
+func (p *pipeline) push(e *types.Event) {
+	select {
+	case p.queue <- item{event: e}:
+		p.enqueued.Add(1)
+		return
+	default:
+	}
+
+	if p.drop {
+		p.dropped.Add(1)
+		return
+	}
+	p.blocked.Add(1)
+	start := time.Now()
+	p.queue <- item{event: e}
+	p.blockedTime.Add(int64(time.Since(start)))
+	p.enqueued.Add(1)
+}
+
+// pushCheckpoint queues the read position of a file behind the events read
+// before it. Checkpoints are never dropped.
+func (p *pipeline) pushCheckpoint(cp *db.Checkpoint) {
+	p.queue <- item{cp: cp}
+}
+
+// pushState queues the position of a non-file source, such as the journal
+// cursor, behind the events read before it.
+func (p *pipeline) pushState(key, value string) {
+	p.queue <- item{key: key, value: value}
+}
+
+// pushCaughtUp queues the mark that the initial catch-up has been read.
+func (p *pipeline) pushCaughtUp() {
+	p.queue <- item{caughtUp: true}
+}
+
+// close stops accepting items and waits for the writer to store what is
+// still queued.
+func (p *pipeline) close() {
+	close(p.queue)
+	<-p.done
+}
+
+func (p *pipeline) run() {
+	defer close(p.done)
+
+	flush := time.NewTicker(p.flushInterval)
+	defer flush.Stop()
+	tick := time.NewTicker(p.tickInterval)
+	defer tick.Stop()
+	lastStats := time.Now()
+
+	for {
+		select {
+		case it, ok := <-p.queue:
+			if !ok {
+				p.closing = true
+				p.flush()
+				p.flush() // what the observers made of the last batch
+				for _, o := range p.observers {
+					if f, ok := o.(Flusher); ok {
+						f.Flush()
+					}
+				}
+				p.saveStats()
+				return
+			}
+			if it.caughtUp {
+				p.caughtUp()
+				continue
+			}
+			p.add(it)
+			if len(p.events) >= p.batchSize {
+				p.flush()
+			}
+		case <-flush.C:
+			p.flush()
+		case now := <-tick.C:
+			p.flush()
+			p.tick(now)
+			if now.Sub(lastStats) >= statsInterval {
+				p.saveStats()
+				lastStats = now
+			}
+		}
+	}
+}
+
+func (p *pipeline) add(it item) {
+	if it.cp != nil {
+		p.checkpoints[it.cp.Path] = it.cp
+		return
+	}
+	if it.key != "" {
+		p.state[it.key] = it.value
+		return
+	}
+	p.events = append(p.events, it.event)
+	p.observe = append(p.observe, true)
+}
+
+// derived queues events produced by observers. They are stored with the
+// next batch but not observed again.
+func (p *pipeline) derived(events []*types.Event) {
+	for _, e := range events {
+		p.events = append(p.events, e)
+		p.observe = append(p.observe, false)
+	}
+}
+
+// updated queues the incidents the observers have changed, to be written
+// with the next batch.
+func (p *pipeline) updated() {
+	for _, o := range p.observers {
+		if u, ok := o.(IncidentUpdater); ok {
+			p.incidents = append(p.incidents, u.UpdatedIncidents()...)
+		}
+	}
+}
+
+// flush writes the pending batch and hands the stored events to the
+// observers. A failed batch is retried until it is written: the readers
+// have already moved past its lines, so discarding it would lose them for
+// good. Meanwhile the queue fills up and the overflow policy applies.
+func (p *pipeline) flush() {
+	if len(p.events) == 0 && len(p.incidents) == 0 && len(p.checkpoints) == 0 && len(p.state) == 0 {
+		return
+	}
+
+	events, observe, incidents := p.events, p.observe, p.incidents
+	checkpoints := make([]*db.Checkpoint, 0, len(p.checkpoints))
+	for _, cp := range p.checkpoints {
+		checkpoints = append(checkpoints, cp)
+	}
+	state := p.state
+	p.events, p.observe, p.incidents = nil, nil, nil
+	p.checkpoints = make(map[string]*db.Checkpoint)
+	p.state = make(map[string]string)
+
+	start := time.Now()
+	delay := firstRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := db.WriteBatch(events, incidents, checkpoints, state)
+		if err == nil {
+			break
+		}
+		p.failed.Add(int64(len(events)))
+		if p.closing && attempt >= closeRetries {
+			log.Printf("Failed to write %d events: %v; giving up", len(events), err)
+			return
+		}
+		log.Printf("Failed to write %d events: %v; retrying in %s", len(events), err, delay)
+		time.Sleep(delay)
+		start = time.Now()
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+	p.lastFlush.Store(int64(time.Since(start)))
+	p.lastBatch.Store(int64(len(events)))
+	p.written.Add(int64(len(events)))
+	p.batches.Add(1)
+
+	for i, e := range events {
+		if !observe[i] {
+			continue
+		}
+		for _, o := range p.observers {
+			p.derived(o.Observe(e))
+		}
+	}
+	p.updated()
+}
+
+// caughtUp stores and observes everything queued during the initial
+// catch-up, then tells the observers waiting for it.
+func (p *pipeline) caughtUp() {
+	p.flush()
+	p.flush() // what the observers made of the last batch
+	for _, o := range p.observers {
+		if r, ok := o.(Resumer); ok {
+			p.derived(r.CaughtUp())
+		}
+	}
+	p.updated()
+}
+
+func (p *pipeline) tick(now time.Time) {
+	for _, o := range p.observers {
+		if t, ok := o.(Ticker); ok {
+			p.derived(t.Tick(now))
+		}
+	}
+	p.updated()
+}
+
+func (p *pipeline) stats() PipelineStats {
+	overflow := "block"
+	if p.drop {
+		overflow = "drop"
+	}
+	return PipelineStats{
+		QueueDepth:    len(p.queue),
+		QueueCapacity: cap(p.queue),
+		Overflow:      overflow,
+		Enqueued:      p.enqueued.Load(),
+		Written:       p.written.Load(),
+		Dropped:       p.dropped.Load(),
+		Blocked:       p.blocked.Load(),
+		BlockedTime:   time.Duration(p.blockedTime.Load()),
+		Failed:        p.failed.Load(),
+		Batches:       p.batches.Load(),
+		LastBatch:     int(p.lastBatch.Load()),
+		LastFlush:     time.Duration(p.lastFlush.Load()),
+		UpdatedAt:     time.Now(),
+	}
+}
+
+func (p *pipeline) saveStats() {
+	data, err := json.Marshal(p.stats())
+	if err != nil {
+		return
+	}
+	if err := db.SetConfigValue(StatsKey, string(data)); err != nil {
+		log.Printf("Failed to save pipeline stats: %v", err)
+	}
+}
+
+// LoadStats reads the metrics last published by a running pipeline. It
+// returns nil when none have been recorded.
+func LoadStats() (*PipelineStats, error) {
+	value, _, err := db.GetConfigValue(StatsKey)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var s PipelineStats
+	if err := json.Unmarshal([]byte(value), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
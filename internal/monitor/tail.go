@@ -0,0 +1,183 @@
+package monitor
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/internal/parser"
+	"github.com/SdxShadow/Mlog/internal/parser/multiline"
+)
+
+// headBytes is how much of the start of a file goes into its checkpoint
+// hash. It only needs to tell two different files apart.
+const headBytes = 1024
+
+// tailedFile follows a single log file by path. The open descriptor keeps
+// pointing at the original inode after a rename, which lets the watcher
+// drain a rotated file before switching to the new one.
+type tailedFile struct {
+	path   string
+	file   *os.File
+	inode  uint64
+	offset int64
+	parser parser.Parser
+	ml     *multiline.Assembler
+	tags   map[string]string
+
+	saved    int64
+	headHash string
+}
+
+func (t *tailedFile) open(offset int64) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if offset < 0 || offset > info.Size() {
+		offset = info.Size()
+	}
+	t.file = f
+	t.inode = inodeOf(info)
+	t.offset = offset
+	t.saved = -1
+	t.headHash = ""
+	return nil
+}
+
+// resume positions an open file according to a stored checkpoint. It
+// returns false when the checkpoint belongs to a different file, in which
+// case the caller decides how to recover.
+func (t *tailedFile) resume(cp *db.Checkpoint) bool {
+	info, err := t.file.Stat()
+	if err != nil || info.Size() < cp.Offset {
+		return false
+	}
+	hash, err := hashHead(t.file, cp.Offset)
+	if err != nil || hash != cp.HeadHash {
+		return false
+	}
+	t.offset = cp.Offset
+	return true
+}
+
+// checkpoint returns the current read position, or nil when nothing has
+// changed since the last call. A multiline entry still being assembled is
+// not covered, so that it is read again after a restart.
+func (t *tailedFile) checkpoint() *db.Checkpoint {
+	if t.file == nil {
+		return nil
+	}
+	offset := t.offset
+	if t.ml != nil {
+		if pending, ok := t.ml.Pending(); ok && pending < offset {
+			offset = pending
+		}
+	}
+	if offset == t.saved {
+		return nil
+	}
+	// Once the offset is past the head the hash no longer changes.
+	if t.headHash == "" || t.saved < headBytes || offset < headBytes {
+		hash, err := hashHead(t.file, offset)
+		if err != nil {
+			return nil
+		}
+		t.headHash = hash
+	}
+	t.saved = offset
+	return &db.Checkpoint{
+		Path:     t.path,
+		Inode:    t.inode,
+		Offset:   offset,
+		HeadHash: t.headHash,
+	}
+}
+
+// rewind restarts reading from the beginning of the same file.
+func (t *tailedFile) rewind() {
+	t.offset = 0
+	t.headHash = ""
+}
+
+func (t *tailedFile) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// truncated reports whether the file shrank below the read offset,
+// which is what copytruncate rotation looks like from the reader side.
+func (t *tailedFile) truncated() bool {
+	info, err := t.file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Size() < t.offset
+}
+
+// readLines calls fn for every complete line after the current offset,
+// along with the offset the line starts at. A trailing line without a
+// newline is left for the next read unless final is set, in which case
+// the file is being abandoned and the partial line is delivered as is.
+func (t *tailedFile) readLines(final bool, fn func(line string, start int64)) error {
+	if t.file == nil {
+		return nil
+	}
+	if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(t.file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && final && line != "" {
+				start := t.offset
+				t.offset += int64(len(line))
+				fn(strings.TrimRight(line, "\r"), start)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		start := t.offset
+		t.offset += int64(len(line))
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		fn(line, start)
+	}
+}
+
+func inodeOf(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
+
+// hashHead hashes the first bytes of f, up to limit or headBytes.
+func hashHead(f *os.File, limit int64) (string, error) {
+	if limit > headBytes {
+		limit = headBytes
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, limit)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
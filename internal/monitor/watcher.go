@@ -1,43 +1,114 @@
 package monitor
 
 import (
-	"bufio"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/SdxShadow/Mlog/internal/db"
-	"github.com/SdxShadow/Mlog/internal/parser/application"
-	"github.com/SdxShadow/Mlog/internal/parser/ssh"
+	"github.com/SdxShadow/Mlog/internal/parser"
+	"github.com/SdxShadow/Mlog/internal/parser/multiline"
 	"github.com/SdxShadow/Mlog/pkg/types"
 )
 
 type Watcher struct {
 	serverID   string
-	sshParser  *ssh.Parser
-	nginxParser *application.NginxParser
-	apacheParser *application.ApacheParser
-	pm2Parser   *application.PM2Parser
+	parsers    map[string]parser.Parser
 	watcher    *fsnotify.Watcher
-	files      map[string]int64
+	files      map[string]*tailedFile
+	dirs       map[string]*dirSource
+	rotated    []rotatedFile
+	multiline  map[string]*multiline.Rule
+	fed        map[string]bool // parsers fed by a log file or /dev/kmsg
+	journal    *journalSource
+	kmsg       *kmsgSource
+	observers  []Observer
+	pollInterval time.Duration
+	monitoring types.MonitoringConfig
+	pipe       *pipeline
 	stopCh     chan bool
 }
 
 func NewWatcher(serverID string) *Watcher {
 	return &Watcher{
 		serverID:    serverID,
-		sshParser:   ssh.New(serverID),
-		nginxParser: application.NewNginxParser(serverID),
-		apacheParser: application.NewApacheParser(serverID),
-		pm2Parser:   application.NewPM2Parser(serverID),
-		files:       make(map[string]int64),
+		parsers:     make(map[string]parser.Parser),
+		files:       make(map[string]*tailedFile),
+		dirs:        make(map[string]*dirSource),
+		multiline:   make(map[string]*multiline.Rule),
+		fed:         make(map[string]bool),
+		pollInterval: time.Second,
 		stopCh:      make(chan bool),
 	}
 }
 
+// SetPollInterval sets how often tracked files are re-checked for rotation
+// and missed writes, independently of fsnotify.
+func (w *Watcher) SetPollInterval(d time.Duration) {
+	if d > 0 {
+		w.pollInterval = d
+	}
+}
+
+// SetPipeline configures the queue and batch writer between the log
+// readers and the database. It must be called before Start.
+func (w *Watcher) SetPipeline(cfg types.MonitoringConfig) {
+	w.monitoring = cfg
+}
+
+// SetMultiline joins the lines of a file, or of every file in a directory
+// added with AddDir, according to r before they are parsed. It must be
+// called before the path is added.
+func (w *Watcher) SetMultiline(path string, r *multiline.Rule) {
+	if r != nil {
+		w.multiline[path] = r
+	}
+}
+
+// Stats reports the state of the ingestion pipeline.
+func (w *Watcher) Stats() PipelineStats {
+	if w.pipe == nil {
+		return PipelineStats{}
+	}
+	return w.pipe.stats()
+}
+
+// AddPath follows a file in one of the well-known log locations, choosing
+// its parsers from the path. Other files need AddSource.
 func (w *Watcher) AddPath(path string) error {
+	names := parser.Detect(path)
+	if len(names) == 0 {
+		return fmt.Errorf("no parser known for %s; set one explicitly", path)
+	}
+	return w.AddSource(path, names...)
+}
+
+// AddSource follows a file with the named parsers, tried in order until
+// one returns an event. Adding a path that is already followed adds the
+// parsers to the ones it has.
+func (w *Watcher) AddSource(path string, parsers ...string) error {
+	p, err := w.parser(parsers)
+	if err != nil {
+		return err
+	}
+	if err := w.AddSourceWith(path, p); err != nil {
+		return err
+	}
+	if _, ok := w.files[path]; ok {
+		for _, name := range parsers {
+			w.fed[name] = true
+		}
+	}
+	return nil
+}
+
+// AddSourceWith follows a file with a parser built by the caller, such as
+// one compiled from a custom log definition.
+func (w *Watcher) AddSourceWith(path string, p parser.Parser) error {
 	stat, err := os.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -51,7 +122,175 @@ func (w *Watcher) AddPath(path string) error {
 		return fmt.Errorf("%s is a directory, not a file", path)
 	}
 
-	w.files[path] = stat.Size()
+	return w.track(path, p, nil, false)
+}
+
+// parser returns the parser for a list of names, sharing one instance per
+// name across all sources.
+func (w *Watcher) parser(names []string) (parser.Parser, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no parser given")
+	}
+	var list parser.Chain
+	for _, name := range names {
+		p, ok := w.parsers[name]
+		if !ok {
+			var err error
+			if p, err = parser.New(name, w.serverID); err != nil {
+				return nil, err
+			}
+			w.parsers[name] = p
+		}
+		list = append(list, p)
+	}
+	if len(list) == 1 {
+		return list[0], nil
+	}
+	return list, nil
+}
+
+// MatchFunc decides whether a file appearing in a watched directory should
+// be followed. It returns the metadata to attach to every event read from
+// the file.
+type MatchFunc func(name string) (tags map[string]string, ok bool)
+
+// rotatedFile is the remainder of a file rotated while mlog was down. It
+// is read at Start, before owner, the file that replaced it.
+type rotatedFile struct {
+	prev, owner *tailedFile
+}
+
+type dirSource struct {
+	path   string
+	parser parser.Parser
+	match  MatchFunc
+}
+
+// AddDir follows every file in dir accepted by match, including files
+// created after the watcher has started, and reads them with the named
+// parser.
+func (w *Watcher) AddDir(dir, parserName string, match MatchFunc) error {
+	p, err := w.parser([]string{parserName})
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("Watch directory does not exist: %s", dir)
+			return nil
+		}
+		return err
+	}
+
+	w.dirs[dir] = &dirSource{path: dir, parser: p, match: match}
+	w.fed[parserName] = true
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		tags, ok := match(entry.Name())
+		if !ok {
+			continue
+		}
+		if err := w.track(filepath.Join(dir, entry.Name()), p, tags, false); err != nil {
+			log.Printf("Failed to watch %s: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// track starts following path. Files found at startup resume from their
+// checkpoint or their current end; files created while running are read
+// from the start.
+func (w *Watcher) track(path string, p parser.Parser, tags map[string]string, fromStart bool) error {
+	if tf, ok := w.files[path]; ok {
+		tf.parser = chain(tf.parser, p)
+		return nil
+	}
+
+	offset := int64(-1)
+	if fromStart {
+		offset = 0
+	}
+	tf := &tailedFile{path: path, parser: p, tags: tags}
+	if r, ok := w.multiline[path]; ok {
+		tf.ml = multiline.NewAssembler(r)
+	} else if r, ok := w.multiline[filepath.Dir(path)]; ok && w.dirs[filepath.Dir(path)] != nil {
+		tf.ml = multiline.NewAssembler(r)
+	} else if r := parser.MultilineRule(p); r != nil {
+		tf.ml = multiline.NewAssembler(r)
+	}
+	if err := tf.open(offset); err != nil {
+		return err
+	}
+	w.files[path] = tf
+	if !fromStart {
+		w.restore(tf)
+	}
+	return nil
+}
+
+// chain combines the parsers of a file added more than once.
+func chain(a, b parser.Parser) parser.Parser {
+	c, ok := a.(parser.Chain)
+	if !ok {
+		c = parser.Chain{a}
+	}
+	return append(c, b)
+}
+
+// restore moves a freshly opened file to its stored checkpoint. Without a
+// checkpoint the file is read from its current end, as before. When the
+// file was rotated while mlog was down, the rest of the rotated file is
+// read first if it can still be found, and the new file from the start.
+func (w *Watcher) restore(tf *tailedFile) {
+	cp, err := db.GetCheckpoint(tf.path)
+	if err != nil {
+		log.Printf("Failed to load checkpoint for %s: %v", tf.path, err)
+		return
+	}
+	if cp == nil {
+		return
+	}
+
+	if tf.resume(cp) {
+		return
+	}
+
+	if tf.inode != cp.Inode {
+		if prev := findRotated(tf.path, cp); prev != nil {
+			w.rotated = append(w.rotated, rotatedFile{prev: prev, owner: tf})
+		}
+	} else {
+		log.Printf("Log truncated while stopped, restarting from beginning: %s", tf.path)
+	}
+	tf.rewind()
+}
+
+// findRotated looks next to path for the file a checkpoint was taken on,
+// e.g. auth.log.1 or auth.log-20240101, and opens it at the checkpoint.
+func findRotated(path string, cp *db.Checkpoint) *tailedFile {
+	dotted, _ := filepath.Glob(path + ".*")
+	dashed, _ := filepath.Glob(path + "-*")
+	for _, m := range append(dotted, dashed...) {
+		if strings.HasSuffix(m, ".gz") || strings.HasSuffix(m, ".xz") || strings.HasSuffix(m, ".bz2") {
+			continue
+		}
+		info, err := os.Stat(m)
+		if err != nil || inodeOf(info) != cp.Inode {
+			continue
+		}
+		prev := &tailedFile{path: m}
+		if err := prev.open(-1); err != nil {
+			continue
+		}
+		if prev.resume(cp) {
+			return prev
+		}
+		prev.close()
+	}
 	return nil
 }
 
@@ -62,141 +301,254 @@ func (w *Watcher) Start() error {
 	}
 	w.watcher = watcher
 
+	w.pipe = newPipeline(w.monitoring, w.pollInterval, w.observers)
+	go w.pipe.run()
+
+	// Watch parent directories rather than the files themselves so that
+	// renames and re-creations by logrotate are still reported.
+	dirs := make(map[string]bool)
 	for path := range w.files {
-		if err := watcher.Add(path); err != nil {
-			log.Printf("Failed to watch %s: %v", path, err)
+		dirs[filepath.Dir(path)] = true
+	}
+	for dir := range w.dirs {
+		dirs[dir] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("Failed to watch %s: %v", dir, err)
 		}
 	}
 
+	// Catch up on anything written since the checkpoints were taken.
+	for _, r := range w.rotated {
+		log.Printf("Resuming rotated file %s", r.prev.path)
+		w.drain(r.prev, r.owner)
+		r.prev.close()
+	}
+	w.rotated = nil
+	for _, tf := range w.files {
+		w.readNewLines(tf)
+	}
+
+	if w.journal != nil {
+		w.journal.catchUp()
+	}
+	w.pipe.pushCaughtUp()
+
+	if w.kmsg != nil {
+		w.kmsg.start()
+	}
+	if w.journal != nil {
+		w.journal.start()
+	}
+
 	go w.run()
 	return nil
 }
 
 func (w *Watcher) run() {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case event, ok := <-w.watcher.Events:
 			if !ok {
 				return
 			}
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				w.readNewLines(event.Name)
+			w.handleEvent(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
 			}
+			log.Printf("Watcher error: %v", err)
+		case <-ticker.C:
+			w.poll()
 		case <-w.stopCh:
 			return
 		}
 	}
 }
 
-func (w *Watcher) readNewLines(path string) {
-	file, err := os.Open(path)
-	if err != nil {
-		log.Printf("Failed to open %s: %v", path, err)
+func (w *Watcher) handleEvent(event fsnotify.Event) {
+	tf, ok := w.files[event.Name]
+	if !ok {
+		if event.Has(fsnotify.Create) {
+			w.discover(event.Name)
+		}
 		return
 	}
-	defer file.Close()
 
-	lastPos := w.files[path]
-	file.Seek(lastPos, 0)
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
-
-		event := w.parseLine(path, line)
-		if event != nil {
-			if err := db.InsertEvent(event); err != nil {
-				log.Printf("Failed to insert event: %v", err)
-			}
-		}
+	switch {
+	case event.Has(fsnotify.Create):
+		w.reopen(tf)
+	case event.Has(fsnotify.Write):
+		w.readNewLines(tf)
+	case event.Has(fsnotify.Rename), event.Has(fsnotify.Remove):
+		// The descriptor still refers to the old inode; take whatever was
+		// written before the rotation. The new file is picked up on Create
+		// or, failing that, by the next poll.
+		w.readNewLines(tf)
 	}
+}
 
-	info, err := file.Stat()
-	if err == nil {
-		w.files[path] = info.Size()
+// discover starts following a new file in a watched directory.
+func (w *Watcher) discover(path string) {
+	ds, ok := w.dirs[filepath.Dir(path)]
+	if !ok {
+		return
 	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return
+	}
+	tags, ok := ds.match(filepath.Base(path))
+	if !ok {
+		return
+	}
+	if err := w.track(path, ds.parser, tags, true); err != nil {
+		log.Printf("Failed to watch %s: %v", path, err)
+		return
+	}
+	log.Printf("Watching new log file %s", path)
+	w.readNewLines(w.files[path])
 }
 
-func (w *Watcher) parseLine(path, line string) *types.Event {
-	ts := time.Now()
+// poll catches rotations and writes that fsnotify did not report, such as
+// a rename into place or events dropped under load. It also completes
+// multiline entries that have stopped growing.
+func (w *Watcher) poll() {
+	now := time.Now()
+	for _, tf := range w.files {
+		if tf.ml != nil && tf.ml.Expired(now) {
+			w.flushEntry(tf)
+			w.saveCheckpoint(tf)
+		}
 
-	if isAuthLog(path) {
-		return w.sshParser.Parse(line, ts)
+		info, err := os.Stat(tf.path)
+		if err != nil {
+			w.readNewLines(tf)
+			continue
+		}
+		if tf.file == nil || inodeOf(info) != tf.inode {
+			w.reopen(tf)
+			continue
+		}
+		w.readNewLines(tf)
 	}
+}
 
-	if isNginxAccess(path) {
-		return w.nginxParser.ParseAccess(line, ts)
+// reopen drains the currently open file to its end and switches to the
+// file now present at the same path, reading it from the start.
+func (w *Watcher) reopen(tf *tailedFile) {
+	if tf.file != nil {
+		info, err := os.Stat(tf.path)
+		if err == nil && inodeOf(info) == tf.inode {
+			w.readNewLines(tf)
+			return
+		}
+		w.drain(tf, tf)
+		tf.close()
 	}
 
-	if isNginxError(path) {
-		return w.nginxParser.ParseError(line, ts)
+	if err := tf.open(0); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to open %s: %v", tf.path, err)
+		}
+		return
 	}
+	log.Printf("Log rotated, reopened %s", tf.path)
+	w.readNewLines(tf)
+}
 
-	if isApacheAccess(path) {
-		return w.apacheParser.ParseAccess(line, ts)
+func (w *Watcher) readNewLines(tf *tailedFile) {
+	if tf.file == nil {
+		return
 	}
 
-	if isApacheError(path) {
-		return w.apacheParser.ParseError(line, ts)
+	if tf.truncated() {
+		log.Printf("Log truncated, restarting from beginning: %s", tf.path)
+		w.flushEntry(tf)
+		tf.rewind()
 	}
 
-	if isPM2Log(path) {
-		return w.pm2Parser.Parse(line, ts)
+	if err := tf.readLines(false, func(line string, start int64) {
+		w.handleLine(tf, line, start)
+	}); err != nil {
+		log.Printf("Failed to read %s: %v", tf.path, err)
 	}
-
-	return nil
+	w.saveCheckpoint(tf)
 }
 
-func isAuthLog(path string) bool {
-	return contains(path, "/var/log/auth.log", "/var/log/secure")
-}
-
-func isNginxAccess(path string) bool {
-	return contains(path, "/nginx/access.log")
-}
-
-func isNginxError(path string) bool {
-	return contains(path, "/nginx/error.log")
-}
-
-func isApacheAccess(path string) bool {
-	return contains(path, "/apache2/access.log", "/httpd/access_log")
+// saveCheckpoint queues the read position behind the lines just read, so
+// it is committed in the same transaction as their events.
+func (w *Watcher) saveCheckpoint(tf *tailedFile) {
+	if cp := tf.checkpoint(); cp != nil {
+		w.pipe.pushCheckpoint(cp)
+	}
 }
 
-func isApacheError(path string) bool {
-	return contains(path, "/apache2/error.log", "/httpd/error_log")
+// drain reads a file that is about to be closed, including a final line
+// that was never terminated. Lines are parsed as coming from owner, the
+// tracked file that tf was rotated away from.
+func (w *Watcher) drain(tf, owner *tailedFile) {
+	if err := tf.readLines(true, func(line string, start int64) {
+		w.handleLine(owner, line, start)
+	}); err != nil {
+		log.Printf("Failed to drain %s: %v", tf.path, err)
+	}
+	w.flushEntry(owner)
 }
 
-func isPM2Log(path string) bool {
-	return contains(path, "/.pm2/logs/", "pm2.log")
+// handleLine parses a line read at offset start, or adds it to the
+// multiline entry being assembled for the file.
+func (w *Watcher) handleLine(tf *tailedFile, line string, start int64) {
+	if tf.ml != nil {
+		entry, ok := tf.ml.Add(line, start, time.Now())
+		if !ok {
+			return
+		}
+		line = entry
+	}
+	w.parse(tf, line)
 }
 
-func contains(s string, subs ...string) bool {
-	for _, sub := range subs {
-		if len(s) >= len(sub) && (s[len(s)-len(sub):] == sub || s == sub) {
-			return true
-		}
-		if len(s) >= len(sub) && indexOf(sub, s) >= 0 {
-			return true
-		}
+// flushEntry parses the multiline entry still being assembled, if any.
+func (w *Watcher) flushEntry(tf *tailedFile) {
+	if tf.ml == nil {
+		return
+	}
+	if entry, ok := tf.ml.Flush(); ok {
+		w.parse(tf, entry)
 	}
-	return false
 }
 
-func indexOf(sub, s string) int {
-	for i := 0; i <= len(s)-len(sub); i++ {
-		if s[i:i+len(sub)] == sub {
-			return i
+func (w *Watcher) parse(tf *tailedFile, line string) {
+	// Parsers take the event time from the line itself; the ingest time
+	// is only a fallback.
+	event := tf.parser.Parse(line, time.Now())
+	if event != nil {
+		for k, v := range tf.tags {
+			event.SetMetadata(k, v)
 		}
+		w.emit(event)
 	}
-	return -1
 }
 
 func (w *Watcher) Stop() error {
 	w.stopCh <- true
+	if w.kmsg != nil {
+		w.kmsg.stop()
+	}
+	if w.journal != nil {
+		w.journal.stop()
+	}
+	for _, tf := range w.files {
+		tf.close()
+	}
+	if w.pipe != nil {
+		w.pipe.close()
+	}
 	if w.watcher != nil {
 		return w.watcher.Close()
 	}
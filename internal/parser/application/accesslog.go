@@ -0,0 +1,255 @@
+package application
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/parser/timestamp"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// accessFormat is a compiled access log format. Variables are named as
+// nginx names them ($remote_addr, $status, ...); other servers' formats
+// are translated to the same names, so every request event carries the
+// same metadata keys.
+type accessFormat struct {
+	re   *regexp.Regexp
+	vars []string // the variable captured by each group
+}
+
+// formatBuilder assembles the regexp of an access log format from its
+// literal text and variables.
+type formatBuilder struct {
+	parts []string
+	vars  []string
+	last  int // index in parts of the last variable's pattern
+}
+
+func (b *formatBuilder) literal(s string) {
+	if s != "" {
+		b.parts = append(b.parts, regexp.QuoteMeta(s))
+	}
+}
+
+func (b *formatBuilder) variable(name string) {
+	b.vars = append(b.vars, name)
+	b.parts = append(b.parts, "("+varPattern(name)+")")
+	b.last = len(b.parts) - 1
+}
+
+func (b *formatBuilder) compile() (*accessFormat, error) {
+	// A variable at the very end takes the rest of the line.
+	if len(b.vars) > 0 && b.last == len(b.parts)-1 && b.parts[b.last] == "(.*?)" {
+		b.parts[b.last] = "(.*)"
+	}
+	re, err := regexp.Compile("^" + strings.Join(b.parts, ""))
+	if err != nil {
+		return nil, err
+	}
+	return &accessFormat{re: re, vars: b.vars}, nil
+}
+
+// varPattern is what a variable matches. Addresses and numbers are matched
+// as such so that formats with variables side by side still split
+// correctly; the rest match as little as possible up to the text that
+// follows them.
+func varPattern(name string) string {
+	switch name {
+	case "remote_addr", "remote_logname", "server_addr", "server_name", "request_uri":
+		return `\S+`
+	case "uri":
+		return `[^?\s]*`
+	case "is_args":
+		return `\??`
+	case "args":
+		return `\S*`
+	case "status":
+		return `\d{3}|-`
+	case "body_bytes_sent", "bytes_sent", "request_length", "remote_port", "server_port", "connection", "pid",
+		"request_time_us", "request_time_ms", "time_ms", "time_us":
+		return `\d+|-`
+	case "request_time", "msec":
+		return `[\d.]+|-`
+	case "upstream_response_time", "upstream_connect_time", "upstream_header_time":
+		// One value per upstream tried: "0.004, 0.012" or "0.004 : 0.012".
+		return `[\d.]+(?:(?:, | : )[\d.]+)*|-`
+	case "upstream_status":
+		return `\d{3}(?:(?:, | : )\d{3})*|-`
+	}
+	return `.*?`
+}
+
+// match returns the variables of a line, leaving out the ones logged as
+// "-", or nil when the line does not have the format.
+func (f *accessFormat) match(line string) map[string]string {
+	m := f.re.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	values := make(map[string]string, len(f.vars))
+	for i, name := range f.vars {
+		if v := m[i+1]; v != "" && v != "-" {
+			values[name] = v
+		}
+	}
+	return values
+}
+
+// accessMetadata renames variables for the metadata of a request event;
+// the others keep their name.
+var accessMetadata = map[string]string{
+	"http_referer":         "referer",
+	"http_user_agent":      "useragent",
+	"http_x_forwarded_for": "x_forwarded_for",
+}
+
+// accessEvent builds a request event from the variables of a line.
+func accessEvent(serverID string, eventType types.EventType, values map[string]string, line string, ts time.Time) *types.Event {
+	event := &types.Event{
+		Timestamp: ts,
+		ServerID:  serverID,
+		EventType: eventType,
+		Severity:  types.SeverityInfo,
+		SourceIP:  values["remote_addr"],
+		Username:  values["remote_user"],
+		RawLog:    line,
+	}
+
+	timeUnits(values)
+	switch {
+	case values["time_local"] != "":
+		if t, ok := timestamp.CLF(values["time_local"]); ok {
+			event.Timestamp = t
+		}
+	case values["time_iso8601"] != "":
+		if t, ok := timestamp.RFC3339(values["time_iso8601"]); ok {
+			event.Timestamp = t
+		}
+	case values["msec"] != "":
+		if f, err := strconv.ParseFloat(values["msec"], 64); err == nil {
+			event.Timestamp = time.UnixMilli(int64(f * 1000))
+		}
+	}
+
+	method, uri, protocol := values["request_method"], values["request_uri"], values["server_protocol"]
+	if uri == "" && values["uri"] != "" {
+		uri = values["uri"]
+		if args := values["args"]; args != "" {
+			uri += "?" + args
+		}
+	}
+	if r := values["request"]; r != "" {
+		parts := strings.SplitN(r, " ", 3)
+		if len(parts) >= 2 {
+			method, uri = parts[0], parts[1]
+			if len(parts) == 3 {
+				protocol = parts[2]
+			}
+		} else {
+			// Not HTTP, e.g. a TLS handshake sent to a plain port.
+			uri = r
+		}
+	}
+
+	metadata := make(map[string]interface{})
+	for name, v := range values {
+		switch name {
+		case "remote_addr", "remote_user", "time_local", "time_iso8601", "msec",
+			"request", "request_method", "request_uri", "uri", "is_args", "args", "server_protocol", "status":
+			continue
+		case "body_bytes_sent", "bytes_sent":
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				if _, ok := metadata["bytes"]; !ok || name == "body_bytes_sent" {
+					metadata["bytes"] = n
+				}
+			}
+		case "request_length", "server_port":
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				metadata[name] = n
+			}
+		case "remote_port":
+			event.SourcePort, _ = strconv.Atoi(v)
+		case "request_time":
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				metadata["request_time"] = f
+			}
+		case "upstream_response_time", "upstream_connect_time", "upstream_header_time":
+			if f, ok := sumTimes(v); ok {
+				metadata[name] = f
+			}
+		case "host", "http_host", "server_name":
+			// $host is the most reliable of the three.
+			if _, ok := metadata["host"]; !ok || name == "host" {
+				metadata["host"] = v
+			}
+		default:
+			if key, ok := accessMetadata[name]; ok {
+				metadata[key] = v
+			} else {
+				metadata[name] = v
+			}
+		}
+	}
+	if method != "" {
+		metadata["method"] = method
+	}
+	if uri != "" {
+		metadata["uri"] = uri
+	}
+	if protocol != "" {
+		metadata["protocol"] = protocol
+	}
+
+	status, _ := strconv.Atoi(values["status"])
+	if status > 0 {
+		metadata["status"] = status
+	}
+	if status >= 500 {
+		event.Severity = types.SeverityError
+	} else if status >= 400 {
+		event.Severity = types.SeverityWarning
+	}
+
+	event.Message = strings.TrimSpace(method + " " + uri + " -> " + values["status"])
+	event.Metadata = metadata
+	return event
+}
+
+// timeUnits converts times logged in other units than nginx's seconds,
+// named with a _ms, _us or _ns suffix: Apache's %D, Traefik's
+// nanosecond durations.
+func timeUnits(values map[string]string) {
+	for name, v := range values {
+		for suffix, scale := range map[string]float64{"_ms": 1e3, "_us": 1e6, "_ns": 1e9} {
+			base := strings.TrimSuffix(name, suffix)
+			if base == name {
+				continue
+			}
+			target := base
+			if base == "time" {
+				target = "msec"
+			} else if base != "request_time" && !strings.HasPrefix(base, "upstream_") {
+				continue
+			}
+			delete(values, name)
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				values[target] = strconv.FormatFloat(n/scale, 'f', -1, 64)
+			}
+		}
+	}
+}
+
+// sumTimes adds up the per-upstream times of a retried request.
+func sumTimes(v string) (float64, bool) {
+	var total float64
+	ok := false
+	for _, f := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ':' || r == ' ' }) {
+		if n, err := strconv.ParseFloat(f, 64); err == nil {
+			total += n
+			ok = true
+		}
+	}
+	return total, ok
+}
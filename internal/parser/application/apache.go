@@ -1,64 +1,284 @@
 package application
 
 import (
+	"fmt"
 	"regexp"
-	"strconv"
+	"strings"
 	"time"
 
+	"github.com/SdxShadow/Mlog/internal/parser/timestamp"
 	"github.com/SdxShadow/Mlog/pkg/types"
 )
 
 type ApacheParser struct {
 	serverID string
+	formats  []*accessFormat
+}
+
+// The LogFormat nicknames defined in the stock httpd.conf and, for
+// vhost_combined, in Debian's apache2.conf.
+var ApacheFormats = map[string]string{
+	"common":         `%h %l %u %t "%r" %>s %b`,
+	"combined":       `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"`,
+	"vhost_combined": `%v:%p %h %l %u %t "%r" %>s %O "%{Referer}i" "%{User-Agent}i"`,
+	"referer":        `%{Referer}i -> %U`,
+	"agent":          `%{User-agent}i`,
+}
+
+// apacheDefault are tried in turn when no LogFormat is configured. The
+// longer formats come first, since a shorter one matches the start of
+// their lines.
+var apacheDefault = []*accessFormat{
+	mustCompileApache(ApacheFormats["vhost_combined"]),
+	mustCompileApache(ApacheFormats["combined"]),
+	mustCompileApache(ApacheFormats["common"]),
 }
 
 func NewApacheParser(serverID string) *ApacheParser {
-	return &ApacheParser{serverID: serverID}
+	return &ApacheParser{serverID: serverID, formats: apacheDefault}
 }
 
-var apacheAccessPattern = regexp.MustCompile(`^(\S+)\s+\S+\s+\S+\s+\[([^\]]+)\]\s+"(\S+)\s+(\S+)\s+\S+"\s+(\d+)\s+(\d+|-)`)
+// NewApacheFormatParser reads access logs written with a LogFormat. format
+// is the format string, with or without the LogFormat directive around
+// it, or one of the ApacheFormats nicknames.
+func NewApacheFormatParser(serverID, format string) (*ApacheParser, error) {
+	if strings.TrimSpace(format) == "" {
+		return NewApacheParser(serverID), nil
+	}
+	f, err := compileApacheFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	return &ApacheParser{serverID: serverID, formats: []*accessFormat{f}}, nil
+}
 
 func (p *ApacheParser) ParseAccess(line string, ts time.Time) *types.Event {
-	m := apacheAccessPattern.FindStringSubmatch(line)
-	if len(m) < 7 {
-		return nil
+	for _, f := range p.formats {
+		if values := f.match(line); values != nil {
+			apacheUnits(values)
+			return accessEvent(p.serverID, types.EventApacheRequest, values, line, ts)
+		}
 	}
+	return nil
+}
 
-	status, _ := strconv.Atoi(m[5])
-	severity := types.SeverityInfo
-	if status >= 500 {
-		severity = types.SeverityError
-	} else if status >= 400 {
-		severity = types.SeverityWarning
+// apacheUnits adjusts the values Apache logs differently from nginx.
+func apacheUnits(values map[string]string) {
+	if args, ok := values["args"]; ok {
+		values["args"] = strings.TrimPrefix(args, "?")
 	}
+}
 
-	return &types.Event{
-		Timestamp:  ts,
-		ServerID:   p.serverID,
-		EventType:  types.EventApacheRequest,
-		Severity:   severity,
-		SourceIP:   m[1],
-		Message:    m[3] + " " + m[4] + " -> " + m[5],
-		RawLog:     line,
-		Metadata:   map[string]interface{}{
-			"method": m[3],
-			"uri":    m[4],
-			"status": status,
-			"bytes":  m[6],
-		},
+func compileApacheFormat(format string) (*accessFormat, error) {
+	if f, ok := ApacheFormats[strings.TrimSpace(format)]; ok {
+		format = f
+	} else {
+		format = apacheFormatText(format)
+	}
+
+	var b formatBuilder
+	var lit strings.Builder
+	for i := 0; i < len(format); {
+		if format[i] != '%' {
+			lit.WriteByte(format[i])
+			i++
+			continue
+		}
+		i++
+		// Status conditions and the < > of original or final request.
+		for i < len(format) && strings.IndexByte("!<>0123456789,", format[i]) >= 0 {
+			i++
+		}
+		arg := ""
+		if i < len(format) && format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated %%{ in LogFormat")
+			}
+			arg = format[i+1 : i+end]
+			i += end + 1
+		}
+		if i >= len(format) {
+			return nil, fmt.Errorf("LogFormat ends in the middle of a directive")
+		}
+		c := format[i]
+		i++
+
+		if c == '%' {
+			lit.WriteByte('%')
+			continue
+		}
+		name, err := apacheVariable(c, arg)
+		if err != nil {
+			return nil, err
+		}
+		if c == 't' && arg == "" {
+			// %t includes the brackets.
+			lit.WriteByte('[')
+			b.literal(lit.String())
+			lit.Reset()
+			b.variable(name)
+			lit.WriteByte(']')
+			continue
+		}
+		b.literal(lit.String())
+		lit.Reset()
+		b.variable(name)
 	}
+	b.literal(lit.String())
+	if len(b.vars) == 0 {
+		return nil, fmt.Errorf("LogFormat has no directives")
+	}
+	f, err := b.compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid LogFormat: %w", err)
+	}
+	return f, nil
+}
+
+// apacheVariable names the value of a LogFormat directive after the
+// matching nginx variable.
+func apacheVariable(c byte, arg string) (string, error) {
+	switch c {
+	case 'h', 'a':
+		return "remote_addr", nil
+	case 'A':
+		return "server_addr", nil
+	case 'l':
+		return "remote_logname", nil
+	case 'u':
+		return "remote_user", nil
+	case 't':
+		switch arg {
+		case "":
+			return "time_local", nil
+		case "sec":
+			return "msec", nil
+		case "msec":
+			return "time_ms", nil
+		case "usec":
+			return "time_us", nil
+		}
+		return "time", nil
+	case 'r':
+		return "request", nil
+	case 's':
+		return "status", nil
+	case 'b', 'B':
+		return "body_bytes_sent", nil
+	case 'O':
+		return "bytes_sent", nil
+	case 'I':
+		return "request_length", nil
+	case 'S':
+		return "bytes_transferred", nil
+	case 'i':
+		return "http_" + headerName(arg), nil
+	case 'o':
+		return "sent_http_" + headerName(arg), nil
+	case 'C':
+		return "cookie_" + headerName(arg), nil
+	case 'e':
+		return "env_" + headerName(arg), nil
+	case 'n':
+		return "note_" + headerName(arg), nil
+	case 'v':
+		return "server_name", nil
+	case 'V':
+		return "host", nil
+	case 'p':
+		if arg == "remote" {
+			return "remote_port", nil
+		}
+		return "server_port", nil
+	case 'D':
+		return "request_time_us", nil
+	case 'T':
+		switch arg {
+		case "ms":
+			return "request_time_ms", nil
+		case "us":
+			return "request_time_us", nil
+		}
+		return "request_time", nil
+	case 'm':
+		return "request_method", nil
+	case 'U':
+		return "uri", nil
+	case 'q':
+		return "args", nil
+	case 'H':
+		return "server_protocol", nil
+	case 'P':
+		return "pid", nil
+	case 'X':
+		return "connection_status", nil
+	case 'k':
+		return "keepalive_requests", nil
+	case 'L':
+		return "log_id", nil
+	case 'R':
+		return "handler", nil
+	case 'f':
+		return "request_filename", nil
+	}
+	return "", fmt.Errorf("unsupported LogFormat directive %%%c", c)
 }
 
-var apacheErrorPattern = regexp.MustCompile(`^\[([A-Z][a-z]{2})\s+([A-Z][a-z]{2}\s+\d+\s+\d{2}:\d{2}:\d{2})\.\d+\s+(\S+)\s+(\S+)\]\s+\[(\w+)\]\s+(.*)`)
+// headerName turns a header such as User-Agent into user_agent, as nginx
+// names $http_user_agent.
+func headerName(h string) string {
+	return strings.ReplaceAll(strings.ToLower(h), "-", "_")
+}
+
+func mustCompileApache(format string) *accessFormat {
+	f, err := compileApacheFormat(format)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// apacheFormatText takes the format as copied from the Apache config:
+// either the bare string, or a LogFormat directive with the string in
+// quotes and the \" escapes that need.
+func apacheFormatText(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "LogFormat") || strings.HasPrefix(s, `"`) {
+		if i := strings.IndexByte(s, '"'); i >= 0 {
+			s = s[i+1:]
+			// The closing quote is the first one not escaped.
+			for j := 0; j < len(s); j++ {
+				if s[j] == '\\' {
+					j++
+					continue
+				}
+				if s[j] == '"' {
+					s = s[:j]
+					break
+				}
+			}
+		}
+	}
+	return strings.ReplaceAll(s, `\"`, `"`)
+}
+
+// apacheErrorPattern accepts both the 2.2 layout, "[Wed Oct 11 14:32:52 2000] [error] ...",
+// and the 2.4 layout, "[Wed Oct 11 14:32:52.123456 2000] [core:error] [pid 1:tid 2] ...".
+var apacheErrorPattern = regexp.MustCompile(`^\[([A-Z][a-z]{2}\s+[A-Z][a-z]{2}\s+\d+\s+\d{2}:\d{2}:\d{2}(?:\.\d+)?\s+\d{4})\]\s+\[(?:[\w-]+:)?(\w+)\]\s+(.*)`)
 
 func (p *ApacheParser) ParseError(line string, ts time.Time) *types.Event {
 	m := apacheErrorPattern.FindStringSubmatch(line)
-	if len(m) < 7 {
+	if len(m) < 4 {
 		return nil
 	}
 
+	if t, ok := timestamp.ApacheError(m[1]); ok {
+		ts = t
+	}
+
 	severity := types.SeverityWarning
-	switch m[5] {
+	switch m[2] {
 	case "error":
 		severity = types.SeverityError
 	case "crit", "alert", "emerg":
@@ -70,10 +290,10 @@ func (p *ApacheParser) ParseError(line string, ts time.Time) *types.Event {
 		ServerID:  p.serverID,
 		EventType: types.EventApacheError,
 		Severity:  severity,
-		Message:   m[6],
+		Message:   m[3],
 		RawLog:    line,
 		Metadata: map[string]interface{}{
-			"level": m[5],
+			"level": m[2],
 		},
 	}
 }
@@ -0,0 +1,306 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// jsonFormat reads access logs written as JSON lines. fields maps access
+// log variables, named as in nginx, to the dotted paths of the JSON values
+// holding them; the first path present is used. With byName, the other
+// keys are taken to be the variable names.
+type jsonFormat struct {
+	fields map[string][]string
+	byName bool
+}
+
+// match returns the variables of a line, and the other values of the
+// line flattened into dotted paths, or nil when the line is not a JSON
+// object.
+func (f *jsonFormat) match(line string) (map[string]string, map[string]interface{}) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		return nil, nil
+	}
+	d := json.NewDecoder(strings.NewReader(line))
+	d.UseNumber()
+	var obj map[string]interface{}
+	if err := d.Decode(&obj); err != nil {
+		return nil, nil
+	}
+	flat := make(map[string]interface{})
+	flatten(flat, "", obj)
+
+	values := make(map[string]string)
+	for name, paths := range f.fields {
+		for _, path := range paths {
+			v, ok := flat[path]
+			if !ok {
+				continue
+			}
+			delete(flat, path)
+			if s := jsonString(v); s != "" && s != "-" {
+				values[name] = s
+				break
+			}
+		}
+	}
+	if f.byName {
+		for path, v := range flat {
+			if _, ok := values[path]; !ok {
+				if s := jsonString(v); s != "" && s != "-" {
+					values[path] = s
+				}
+			}
+		}
+		return values, nil
+	}
+	return values, flat
+}
+
+// flatten adds the values of obj to flat, naming those of nested objects
+// by their path, as in request.headers.User-Agent.
+func flatten(flat map[string]interface{}, prefix string, obj map[string]interface{}) {
+	for k, v := range obj {
+		if nested, ok := v.(map[string]interface{}); ok {
+			flatten(flat, prefix+k+".", nested)
+			continue
+		}
+		flat[prefix+k] = v
+	}
+}
+
+// jsonString is the text of a JSON value. Arrays of strings, such as the
+// header values Caddy logs, are joined.
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, e := range v {
+			if s := jsonString(e); s != "" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ", ")
+	}
+	return ""
+}
+
+// jsonValue is a JSON value as kept in event metadata.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case []interface{}:
+		for _, e := range v {
+			if _, ok := e.(string); !ok {
+				return v
+			}
+		}
+		return jsonString(v)
+	}
+	return v
+}
+
+// jsonPreset is the layout of a server's JSON access log. Servers that
+// have a text format too are read with it when a line is not JSON.
+type jsonPreset struct {
+	eventType types.EventType
+	fields    map[string][]string
+	byName    bool
+	text      string // nginx log_format of the text format
+}
+
+var jsonPresets = map[string]jsonPreset{
+	// Keys named after the variables, as in most escape=json formats.
+	"nginx": {eventType: types.EventNginxRequest, byName: true},
+	// Caddy's structured access log.
+	"caddy": {
+		eventType: types.EventCaddyRequest,
+		fields: map[string][]string{
+			"msec":                 {"ts"},
+			"remote_addr":          {"request.client_ip", "request.remote_ip"},
+			"remote_port":          {"request.remote_port"},
+			"remote_user":          {"user_id"},
+			"request_method":       {"request.method"},
+			"request_uri":          {"request.uri"},
+			"server_protocol":      {"request.proto"},
+			"host":                 {"request.host"},
+			"status":               {"status"},
+			"body_bytes_sent":      {"size"},
+			"request_length":       {"bytes_read"},
+			"request_time":         {"duration"},
+			"http_referer":         {"request.headers.Referer"},
+			"http_user_agent":      {"request.headers.User-Agent"},
+			"http_x_forwarded_for": {"request.headers.X-Forwarded-For"},
+		},
+	},
+	// Traefik's access log with format: json. Durations are nanoseconds.
+	"traefik": {
+		eventType: types.EventTraefikRequest,
+		fields: map[string][]string{
+			"time_iso8601":              {"StartUTC", "StartLocal"},
+			"remote_addr":               {"ClientHost"},
+			"remote_port":               {"ClientPort"},
+			"remote_user":               {"ClientUsername"},
+			"request_method":            {"RequestMethod"},
+			"request_uri":               {"RequestPath"},
+			"server_protocol":           {"RequestProtocol"},
+			"host":                      {"RequestHost"},
+			"status":                    {"DownstreamStatus"},
+			"body_bytes_sent":           {"DownstreamContentSize"},
+			"request_length":            {"RequestContentSize"},
+			"request_time_ns":           {"Duration"},
+			"upstream_response_time_ns": {"OriginDuration"},
+			"upstream_status":           {"OriginStatus"},
+			"upstream_addr":             {"ServiceAddr"},
+			"router":                    {"RouterName"},
+			"service":                   {"ServiceName"},
+			"http_referer":              {"request_Referer"},
+			"http_user_agent":           {"request_User-Agent"},
+			"http_x_forwarded_for":      {"request_X-Forwarded-For"},
+		},
+		// Traefik's default, the common log format with the request count,
+		// router, backend URL and duration appended.
+		text: `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" $request_count "$router" "$upstream_addr" ${request_time_ms}ms`,
+	},
+}
+
+// JSONAccessPresets returns the names of the built-in JSON access log
+// layouts.
+func JSONAccessPresets() []string {
+	names := make([]string, 0, len(jsonPresets))
+	for name := range jsonPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// JSONAccessParser reads access logs written as JSON lines. Its events are
+// request events like those of the nginx and Apache access logs: the mapped
+// values get the same metadata keys, and the other values of the line are
+// kept in the metadata under their path.
+type JSONAccessParser struct {
+	serverID  string
+	eventType types.EventType
+	format    *jsonFormat
+	text      *accessFormat
+}
+
+// NewJSONAccessParser reads a JSON access log with the layout of a preset,
+// the fields of the config, or a preset with some of its fields overridden.
+func NewJSONAccessParser(serverID string, cfg types.JSONAccessConfig) (*JSONAccessParser, error) {
+	p := &JSONAccessParser{
+		serverID:  serverID,
+		eventType: types.EventNginxRequest,
+		format:    &jsonFormat{fields: make(map[string][]string)},
+	}
+	if cfg.Preset != "" {
+		preset, ok := jsonPresets[cfg.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %q (known: %s)", cfg.Preset, strings.Join(JSONAccessPresets(), ", "))
+		}
+		p.eventType = preset.eventType
+		p.format.byName = preset.byName
+		for name, paths := range preset.fields {
+			p.format.fields[name] = paths
+		}
+		if preset.text != "" {
+			p.text = mustCompileNginx(preset.text)
+		}
+	} else if len(cfg.Fields) == 0 {
+		return nil, fmt.Errorf("set a preset or fields")
+	}
+
+	for name, path := range cfg.Fields {
+		if path == "" {
+			return nil, fmt.Errorf("field %s: empty path", name)
+		}
+		p.format.fields[name] = []string{path}
+	}
+	if cfg.EventType != "" {
+		p.eventType = types.EventType(cfg.EventType)
+	}
+	return p, nil
+}
+
+// NewCaddyParser reads Caddy's JSON access log.
+func NewCaddyParser(serverID string) *JSONAccessParser {
+	p, _ := NewJSONAccessParser(serverID, types.JSONAccessConfig{Preset: "caddy"})
+	return p
+}
+
+// NewTraefikParser reads Traefik's access log, in JSON or in its default
+// text format.
+func NewTraefikParser(serverID string) *JSONAccessParser {
+	p, _ := NewJSONAccessParser(serverID, types.JSONAccessConfig{Preset: "traefik"})
+	return p
+}
+
+func (p *JSONAccessParser) ParseAccess(line string, ts time.Time) *types.Event {
+	values, rest := p.format.match(line)
+	if values == nil {
+		if p.text == nil {
+			return nil
+		}
+		if values = p.text.match(line); values == nil {
+			return nil
+		}
+	}
+	return jsonEvent(p.serverID, p.eventType, values, rest, line, ts)
+}
+
+// jsonEvent builds a request event, keeping the unmapped values of the
+// line in its metadata. Lines without a request or status, such as the
+// other messages a server logs to the same file, are skipped.
+func jsonEvent(serverID string, eventType types.EventType, values map[string]string, rest map[string]interface{}, line string, ts time.Time) *types.Event {
+	if values["status"] == "" && values["request"] == "" && values["request_uri"] == "" && values["uri"] == "" {
+		return nil
+	}
+	event := accessEvent(serverID, eventType, values, line, ts)
+	for path, v := range rest {
+		if v == nil {
+			continue
+		}
+		if _, ok := event.Metadata[path]; !ok {
+			event.Metadata[path] = jsonValue(v)
+		}
+	}
+	return event
+}
+
+// nginxJSONKey matches a key of an escape=json log_format and the variable
+// logged under it: "status":"$status" or "status":$status.
+var nginxJSONKey = regexp.MustCompile(`"([^"]+)"\s*:\s*"?\$\{?(\w+)\}?"?`)
+
+// compileNginxJSON reads the keys of a log_format that writes JSON.
+func compileNginxJSON(format string) (*jsonFormat, error) {
+	f := &jsonFormat{fields: make(map[string][]string)}
+	for _, m := range nginxJSONKey.FindAllStringSubmatch(format, -1) {
+		f.fields[m[2]] = append(f.fields[m[2]], m[1])
+	}
+	if len(f.fields) == 0 {
+		return nil, fmt.Errorf("log_format has no variables")
+	}
+	return f, nil
+}
@@ -1,67 +1,151 @@
 package application
 
 import (
+	"fmt"
 	"regexp"
-	"strconv"
+	"strings"
 	"time"
 
+	"github.com/SdxShadow/Mlog/internal/parser/timestamp"
 	"github.com/SdxShadow/Mlog/pkg/types"
 )
 
 type NginxParser struct {
 	serverID string
+	format   *accessFormat
+	json     *jsonFormat // for a log_format that writes JSON
 }
 
+// NginxCombined is nginx's predefined access log format, and NginxMain the
+// "main" format of the stock nginx.conf.
+const (
+	NginxCombined = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+	NginxMain     = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" "$http_x_forwarded_for"`
+)
+
+var nginxCombined = mustCompileNginx(NginxCombined)
+
 func NewNginxParser(serverID string) *NginxParser {
-	return &NginxParser{serverID: serverID}
+	return &NginxParser{serverID: serverID, format: nginxCombined}
 }
 
-var nginxAccessPattern = regexp.MustCompile(`^(\S+)\s+-\s+(\S+)\s+\[([^\]]+)\]\s+"(\S+)\s+(\S+)\s+\S+"\s+(\d+)\s+(\d+)\s+"([^"]*)"\s+"([^"]*)"`)
+// NewNginxFormatParser reads access logs written with a custom log_format.
+// format is the format string as it appears in nginx.conf, with or without
+// the surrounding log_format directive, or the name "combined" or "main".
+// A format that writes JSON lines, as escape=json formats do, is read by
+// the keys it gives the variables.
+func NewNginxFormatParser(serverID, format string) (*NginxParser, error) {
+	if text := strings.TrimSpace(nginxFormatText(format)); strings.HasPrefix(text, "{") {
+		f, err := compileNginxJSON(text)
+		if err != nil {
+			return nil, err
+		}
+		return &NginxParser{serverID: serverID, json: f}, nil
+	}
+	f, err := compileNginxFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	return &NginxParser{serverID: serverID, format: f}, nil
+}
 
 func (p *NginxParser) ParseAccess(line string, ts time.Time) *types.Event {
-	m := nginxAccessPattern.FindStringSubmatch(line)
-	if len(m) < 10 {
+	if p.json != nil {
+		values, rest := p.json.match(line)
+		if values == nil {
+			return nil
+		}
+		return jsonEvent(p.serverID, types.EventNginxRequest, values, rest, line, ts)
+	}
+	values := p.format.match(line)
+	if values == nil {
 		return nil
 	}
+	return accessEvent(p.serverID, types.EventNginxRequest, values, line, ts)
+}
 
-	status, _ := strconv.Atoi(m[6])
-	severity := types.SeverityInfo
-	if status >= 500 {
-		severity = types.SeverityError
-	} else if status >= 400 {
-		severity = types.SeverityWarning
+var nginxVariable = regexp.MustCompile(`\$(?:\{(\w+)\}|(\w+))`)
+
+func compileNginxFormat(format string) (*accessFormat, error) {
+	switch strings.TrimSpace(format) {
+	case "", "combined":
+		format = NginxCombined
+	case "main":
+		format = NginxMain
+	default:
+		format = nginxFormatText(format)
 	}
 
-	return &types.Event{
-		Timestamp:  ts,
-		ServerID:   p.serverID,
-		EventType:  types.EventNginxRequest,
-		Severity:   severity,
-		SourceIP:   m[1],
-		Username:   m[2],
-		Message:    m[4] + " " + m[5] + " -> " + m[6],
-		RawLog:     line,
-		Metadata:   map[string]interface{}{
-			"method":   m[4],
-			"uri":      m[5],
-			"status":   status,
-			"bytes":    m[7],
-			"referer":  m[8],
-			"useragent": m[9],
-		},
+	var b formatBuilder
+	pos := 0
+	for _, m := range nginxVariable.FindAllStringSubmatchIndex(format, -1) {
+		b.literal(format[pos:m[0]])
+		if m[2] >= 0 {
+			b.variable(format[m[2]:m[3]])
+		} else {
+			b.variable(format[m[4]:m[5]])
+		}
+		pos = m[1]
+	}
+	b.literal(format[pos:])
+	if len(b.vars) == 0 {
+		return nil, fmt.Errorf("log_format has no variables")
 	}
+	f, err := b.compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid log_format: %w", err)
+	}
+	return f, nil
+}
+
+func mustCompileNginx(format string) *accessFormat {
+	f, err := compileNginxFormat(format)
+	if err != nil {
+		panic(err)
+	}
+	return f
 }
 
-var nginxErrorPattern = regexp.MustCompile(`^\d{4}/\d{2}/\d{2}\s+\d{2}:\d{2}:\d{2}\s+\[(\w+)\]\s+\d+#\d+:\s+(.*)`)
+// nginxFormatText takes the format as copied from nginx.conf: either the
+// bare string, or the '...' pieces a long format is split into, possibly
+// with the log_format directive and its name in front.
+func nginxFormatText(s string) string {
+	s = strings.TrimSuffix(strings.TrimSpace(s), ";")
+	if strings.HasPrefix(s, "log_format") {
+		if i := strings.IndexAny(s, `'"`); i >= 0 {
+			s = s[i:]
+		}
+	} else if !strings.HasPrefix(s, "'") {
+		return s
+	}
+
+	var b strings.Builder
+	for s = strings.TrimSpace(s); s != "" && (s[0] == '\'' || s[0] == '"'); s = strings.TrimSpace(s) {
+		end := strings.IndexByte(s[1:], s[0])
+		if end < 0 {
+			b.WriteString(s[1:])
+			break
+		}
+		b.WriteString(s[1 : end+1])
+		s = s[end+2:]
+	}
+	return b.String()
+}
+
+var nginxErrorPattern = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2}\s+\d{2}:\d{2}:\d{2})\s+\[(\w+)\]\s+\d+#\d+:\s+(.*)`)
 
 func (p *NginxParser) ParseError(line string, ts time.Time) *types.Event {
 	m := nginxErrorPattern.FindStringSubmatch(line)
-	if len(m) < 3 {
+	if len(m) < 4 {
 		return nil
 	}
 
+	if t, ok := timestamp.NginxError(m[1]); ok {
+		ts = t
+	}
+
 	severity := types.SeverityWarning
-	switch m[1] {
+	switch m[2] {
 	case "error":
 		severity = types.SeverityError
 	case "crit", "alert", "emerg":
@@ -73,7 +157,7 @@ func (p *NginxParser) ParseError(line string, ts time.Time) *types.Event {
 		ServerID:  p.serverID,
 		EventType: types.EventNginxError,
 		Severity:  severity,
-		Message:   m[2],
+		Message:   m[3],
 		RawLog:    line,
 	}
 }
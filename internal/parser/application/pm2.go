@@ -5,6 +5,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/SdxShadow/Mlog/internal/parser/stacktrace"
+	"github.com/SdxShadow/Mlog/internal/parser/timestamp"
 	"github.com/SdxShadow/Mlog/pkg/types"
 )
 
@@ -25,7 +27,52 @@ var (
 	pm2CrashPattern   = regexp.MustCompile(`(SIGSEGV|SIGABRT|SIGBUS|segmentation fault|heap out of memory)`)
 )
 
-func (p *PM2Parser) Parse(line string, ts time.Time) *types.Event {
+var pm2LogNamePattern = regexp.MustCompile(`^(.+)-(out|error)(?:-(\d+))?\.log$`)
+
+// ParsePM2LogName splits a PM2 log file name such as api-out.log or
+// api-error-2.log (cluster mode) into app name, stream and instance id.
+func ParsePM2LogName(name string) (app, stream, instance string, ok bool) {
+	m := pm2LogNamePattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", "", false
+	}
+	return m[1], m[2], m[3], true
+}
+
+// Parse reads one log entry. With multiline assembly an entry can be a
+// whole stack trace; it is classified by its first line and the trace is
+// summarised in the metadata.
+func (p *PM2Parser) Parse(entry string, ts time.Time) *types.Event {
+	line, _, multi := strings.Cut(entry, "\n")
+	if t, _, ok := timestamp.PM2Prefix(line); ok {
+		ts = t
+	}
+
+	event := p.parseLine(line, ts)
+	if event == nil {
+		return nil
+	}
+	event.RawLog = entry
+	if multi {
+		if trace, ok := stacktrace.Parse(stripPM2Prefixes(entry)); ok {
+			trace.Annotate(event.SetMetadata)
+		}
+	}
+	return event
+}
+
+// stripPM2Prefixes removes the timestamp PM2 writes before every line.
+func stripPM2Prefixes(entry string) string {
+	lines := strings.Split(entry, "\n")
+	for i, l := range lines {
+		if _, rest, ok := timestamp.PM2Prefix(l); ok {
+			lines[i] = rest
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *PM2Parser) parseLine(line string, ts time.Time) *types.Event {
 	lineLower := strings.ToLower(line)
 
 	if pm2StartPattern.MatchString(lineLower) {
@@ -0,0 +1,464 @@
+package audit
+
+import (
+	"encoding/hex"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/parser/multiline"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// Parser reads audit.log. An audit event is written as several records
+// sharing the msg=audit(<time>:<serial>) id, e.g. for a command run:
+//
+//	type=SYSCALL msg=audit(1760220855.123:4711): arch=c000003e syscall=59 success=yes exit=0 ... auid=1000 uid=0 ... comm="apt" exe="/usr/bin/apt" key="exec"
+//	type=EXECVE msg=audit(1760220855.123:4711): argc=2 a0="apt" a1="update"
+//	type=CWD msg=audit(1760220855.123:4711): cwd="/root"
+//	type=PROCTITLE msg=audit(1760220855.123:4711): proctitle=61707400757064617465
+//
+// The watcher joins the records of an event before they reach Parse; see
+// Multiline.
+type Parser struct {
+	serverID string
+
+	mu    sync.Mutex
+	users map[string]string // uid -> name
+}
+
+func New(serverID string) *Parser {
+	return &Parser{serverID: serverID, users: make(map[string]string)}
+}
+
+var (
+	// An optional "node=host " prefix, then the record type and event id.
+	recordPattern = regexp.MustCompile(`(?:node=(\S+) )?type=(\S+) msg=audit\((\d+)\.(\d+):(\d+)\):\s?(.*)$`)
+	idPattern     = regexp.MustCompile(`msg=audit\((\d+\.\d+:\d+)\)`)
+	argPattern    = regexp.MustCompile(`^a(\d+)(?:\[(\d+)\])?$`)
+)
+
+// groupTimeout is how long to wait for more records of an event. auditd
+// writes them together, so the wait only delays the last event written.
+const groupTimeout = 500 * time.Millisecond
+
+// Multiline joins the records of one audit event.
+func (p *Parser) Multiline() *multiline.Rule {
+	return multiline.Group(idPattern, groupTimeout)
+}
+
+// encoded are the fields auditd writes in hex when they contain spaces,
+// quotes or control characters, and in double quotes otherwise.
+var encoded = map[string]bool{
+	"comm": true, "exe": true, "name": true, "cwd": true, "proctitle": true,
+	"key": true, "acct": true, "cmd": true, "data": true, "path": true,
+}
+
+type record struct {
+	typ    string
+	fields map[string]string
+}
+
+func (p *Parser) Parse(entry string, ts time.Time) *types.Event {
+	var records []record
+	var id, node string
+	for _, line := range strings.Split(entry, "\n") {
+		m := recordPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if id == "" {
+			node = m[1]
+			id = m[3] + "." + m[4] + ":" + m[5]
+			if secs, err := strconv.ParseInt(m[3], 10, 64); err == nil {
+				msec, _ := strconv.ParseInt(m[4], 10, 64)
+				ts = time.Unix(secs, msec*int64(time.Millisecond))
+			}
+		}
+		r := record{typ: m[2], fields: make(map[string]string)}
+		parseFields(m[6], r.typ == "EXECVE", r.fields)
+		records = append(records, r)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	// The user and configuration records say what happened; the SYSCALL
+	// that may come with them, as with a rule loaded by auditctl, only
+	// says how.
+	var event *types.Event
+	if r := find(records, "USER_LOGIN", "USER_AUTH", "USER_CMD", "CONFIG_CHANGE"); r != nil {
+		switch r.typ {
+		case "USER_LOGIN", "USER_AUTH":
+			event = p.userAuth(*r)
+		case "USER_CMD":
+			event = p.userCmd(*r)
+		case "CONFIG_CHANGE":
+			event = p.configChange(*r)
+		}
+	} else if find(records, "EXECVE") != nil {
+		event = p.execve(records)
+	} else if find(records, "SYSCALL") != nil {
+		event = p.syscall(records)
+	}
+	if event == nil {
+		return nil
+	}
+
+	event.Timestamp = ts
+	event.ServerID = p.serverID
+	event.RawLog = entry
+	event.SetMetadata("audit_id", id)
+	if node != "" {
+		event.SetMetadata("node", node)
+	}
+	return event
+}
+
+func (p *Parser) execve(records []record) *types.Event {
+	x := find(records, "EXECVE")
+	argc, _ := strconv.Atoi(x.fields["argc"])
+	args := make([]string, argc)
+	parts := make(map[int][]string)
+	for k, v := range x.fields {
+		m := argPattern.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		i, _ := strconv.Atoi(m[1])
+		if i >= argc {
+			continue
+		}
+		if m[2] == "" {
+			args[i] = v
+			continue
+		}
+		// Long arguments are split into a1[0], a1[1], ...
+		n, _ := strconv.Atoi(m[2])
+		for len(parts[i]) <= n {
+			parts[i] = append(parts[i], "")
+		}
+		parts[i][n] = v
+	}
+	for i, p := range parts {
+		args[i] = strings.Join(p, "")
+	}
+	cmdline := strings.Join(args, " ")
+
+	e := &types.Event{
+		EventType: types.EventAuditExecve,
+		Severity:  types.SeverityInfo,
+	}
+	if s := find(records, "SYSCALL"); s != nil {
+		p.process(e, s.fields)
+	}
+	p.context(e, records)
+	e.SetMetadata("command", cmdline)
+	e.SetMetadata("argc", argc)
+
+	who := e.Username
+	if who == "" {
+		who = "unknown user"
+	}
+	e.Message = who + " ran: " + cmdline
+	return e
+}
+
+func (p *Parser) syscall(records []record) *types.Event {
+	s := find(records, "SYSCALL")
+	e := &types.Event{
+		EventType: types.EventAuditSyscall,
+		Severity:  types.SeverityInfo,
+	}
+	p.process(e, s.fields)
+	p.context(e, records)
+
+	name := s.fields["SYSCALL"] // the name, in the enriched log format
+	if name == "" {
+		name = "syscall " + s.fields["syscall"]
+	}
+	e.SetMetadata("syscall", name)
+	if v := s.fields["success"]; v != "" {
+		e.SetMetadata("success", v)
+		if v == "no" {
+			e.Severity = types.SeverityWarning
+		}
+	}
+	if v := s.fields["exit"]; v != "" {
+		e.SetMetadata("exit", v)
+	}
+
+	e.Message = name
+	if exe := s.fields["exe"]; exe != "" {
+		e.Message += " by " + exe
+	}
+	if paths, ok := e.GetMetadata("paths").([]string); ok {
+		e.Message += " on " + strings.Join(paths, ", ")
+	}
+	if key := s.fields["key"]; known(key) {
+		e.Message += " (" + key + ")"
+	}
+	return e
+}
+
+// userAuth handles the USER_LOGIN and USER_AUTH records PAM and sshd write.
+func (p *Parser) userAuth(r record) *types.Event {
+	f := r.fields
+	e := &types.Event{
+		EventType: types.EventAuditUserLogin,
+		Severity:  types.SeverityInfo,
+	}
+	verb := "login"
+	if r.typ == "USER_AUTH" {
+		e.EventType = types.EventAuditUserAuth
+		verb = "authentication"
+	}
+	p.process(e, f)
+
+	// acct names the account even when the login failed; id is its uid.
+	switch {
+	case known(f["acct"]):
+		e.Username = f["acct"]
+	case known(f["ID"]):
+		e.Username = f["ID"]
+	case known(f["id"]):
+		e.Username = p.lookup(f["id"])
+	}
+	if known(f["addr"]) {
+		e.SourceIP = f["addr"]
+	}
+	if known(f["terminal"]) {
+		e.SetMetadata("terminal", f["terminal"])
+	}
+	if known(f["op"]) {
+		e.SetMetadata("op", f["op"])
+	}
+	res := f["res"]
+	e.SetMetadata("result", res)
+	if res != "success" {
+		e.Severity = types.SeverityWarning
+	}
+
+	e.Message = verb + " " + e.Username
+	if e.SourceIP != "" {
+		e.Message += " from " + e.SourceIP
+	}
+	if exe := f["exe"]; exe != "" {
+		e.Message += " via " + exe
+	}
+	e.Message += ": " + res
+	return e
+}
+
+// userCmd handles the USER_CMD record sudo writes for each command.
+func (p *Parser) userCmd(r record) *types.Event {
+	f := r.fields
+	e := &types.Event{
+		EventType: types.EventAuditUserCmd,
+		Severity:  types.SeverityInfo,
+	}
+	p.process(e, f)
+	cmd := f["cmd"]
+	e.SetMetadata("command", cmd)
+	if known(f["cwd"]) {
+		e.SetMetadata("cwd", f["cwd"])
+	}
+	if known(f["terminal"]) {
+		e.SetMetadata("terminal", f["terminal"])
+	}
+	res := f["res"]
+	e.SetMetadata("result", res)
+	if res != "success" {
+		e.Severity = types.SeverityWarning
+	}
+
+	who := e.Username
+	if who == "" {
+		who = "unknown user"
+	}
+	e.Message = who + " ran privileged command: " + cmd
+	if res != "success" {
+		e.Message += " (" + res + ")"
+	}
+	return e
+}
+
+// configChange handles changes to the audit rules and settings, which
+// compliance reviews want to see.
+func (p *Parser) configChange(r record) *types.Event {
+	f := r.fields
+	e := &types.Event{
+		EventType: types.EventAuditConfigChange,
+		Severity:  types.SeverityWarning,
+	}
+	p.process(e, f)
+
+	var parts []string
+	for _, k := range []string{"op", "key", "list", "audit_enabled", "audit_backlog_limit", "res"} {
+		if v := f[k]; known(v) {
+			e.SetMetadata(k, v)
+			parts = append(parts, k+"="+v)
+		}
+	}
+	e.Message = "audit configuration changed: " + strings.Join(parts, " ")
+	return e
+}
+
+// process records who did it: the login user (auid), which survives su and
+// sudo, the effective uid and the executable.
+func (p *Parser) process(e *types.Event, f map[string]string) {
+	if auid := f["auid"]; known(auid) && auid != "4294967295" && auid != "-1" {
+		if n, err := strconv.ParseInt(auid, 10, 64); err == nil {
+			e.SetMetadata("auid", n)
+		}
+		if name := f["AUID"]; known(name) {
+			e.Username = name
+		} else {
+			e.Username = p.lookup(auid)
+		}
+	}
+	if uid := f["uid"]; known(uid) {
+		if n, err := strconv.ParseInt(uid, 10, 64); err == nil {
+			e.SetMetadata("uid", n)
+		}
+	}
+	for _, k := range []string{"exe", "comm", "tty", "key"} {
+		if v := f[k]; known(v) {
+			e.SetMetadata(k, v)
+		}
+	}
+	for _, k := range []string{"pid", "ppid", "ses"} {
+		if n, err := strconv.ParseInt(f[k], 10, 64); err == nil && n != 4294967295 {
+			e.SetMetadata(k, n)
+		}
+	}
+}
+
+// context adds the working directory, paths and process title recorded
+// with a syscall.
+func (p *Parser) context(e *types.Event, records []record) {
+	var paths []string
+	for _, r := range records {
+		switch r.typ {
+		case "CWD":
+			if known(r.fields["cwd"]) {
+				e.SetMetadata("cwd", r.fields["cwd"])
+			}
+		case "PATH":
+			if name := r.fields["name"]; known(name) {
+				paths = append(paths, name)
+			}
+		case "PROCTITLE":
+			if t := r.fields["proctitle"]; t != "" {
+				e.SetMetadata("proctitle", t)
+			}
+		}
+	}
+	if len(paths) > 0 {
+		e.SetMetadata("paths", paths)
+	}
+}
+
+// lookup resolves a uid to a user name, remembering the answer.
+func (p *Parser) lookup(uid string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if name, ok := p.users[uid]; ok {
+		return name
+	}
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	p.users[uid] = name
+	return name
+}
+
+// parseFields reads the key=value pairs of a record into fields. Values are
+// bare, "quoted", or hex encoded; the msg='...' of user space records holds
+// more pairs. In EXECVE records the arguments are encoded too.
+func parseFields(s string, execve bool, fields map[string]string) {
+	// The enriched log format separates the resolved names with 0x1d.
+	s = strings.ReplaceAll(s, "\x1d", " ")
+	for {
+		s = strings.TrimLeft(s, " ")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return
+		}
+		key := s[:eq]
+		if sp := strings.LastIndexByte(key, ' '); sp >= 0 {
+			key = key[sp+1:] // skip a stray word
+		}
+		s = s[eq+1:]
+
+		var value string
+		quoted := false
+		switch {
+		case strings.HasPrefix(s, `"`):
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+			quoted = true
+		case strings.HasPrefix(s, "'"):
+			end := strings.IndexByte(s[1:], '\'')
+			inner := s[1:]
+			if end < 0 {
+				s = ""
+			} else {
+				inner, s = s[1:end+1], s[end+2:]
+			}
+			parseFields(inner, false, fields)
+			continue
+		default:
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				value, s = s, ""
+			} else {
+				value, s = s[:end], s[end+1:]
+			}
+		}
+
+		if !quoted && (encoded[key] || execve && argPattern.MatchString(key)) {
+			value = decode(value)
+		}
+		fields[key] = value
+	}
+}
+
+// decode turns a hex encoded value back into text. The NULs separating the
+// arguments of a proctitle become spaces.
+func decode(v string) string {
+	if len(v) == 0 || len(v)%2 != 0 {
+		return v
+	}
+	b, err := hex.DecodeString(v)
+	if err != nil {
+		return v
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(b), "\x00", " "))
+}
+
+// find returns the first record of one of the given types.
+func find(records []record, typ ...string) *record {
+	for i := range records {
+		for _, t := range typ {
+			if records[i].typ == t {
+				return &records[i]
+			}
+		}
+	}
+	return nil
+}
+
+// known reports whether auditd recorded a value. It marks a missing one
+// as "?", and a missing key, name or terminal as "(null)" or "(none)".
+func known(v string) bool {
+	return v != "" && v != "?" && v != "(null)" && v != "(none)"
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// Account changes as logged by shadow-utils and PAM, e.g.
+//
+//	useradd[812]: new user: name=bob, UID=1001, GID=1001, home=/home/bob, shell=/bin/bash, from=/dev/pts/0
+//	usermod[840]: add 'bob' to group 'docker'
+//	passwd[851]: pam_unix(passwd:chauthtok): password changed for bob
+//	gpasswd[860]: user bob added by root to group devs
+var (
+	newUserPattern       = regexp.MustCompile(`^new user: (.*)$`)
+	newGroupPattern      = regexp.MustCompile(`^new group: (.*)$`)
+	deleteUserPattern    = regexp.MustCompile(`^delete user '([^']+)'`)
+	deleteGroupPattern   = regexp.MustCompile(`^(?:group '([^']+)' removed$|removed group '([^']+)')`)
+	addToGroupPattern    = regexp.MustCompile(`^add '([^']+)' to group '([^']+)'`)
+	removeFromGroupPat   = regexp.MustCompile(`^delete '([^']+)' from group '([^']+)'`)
+	changeUserPattern    = regexp.MustCompile(`^(change|lock|unlock) user '([^']+)' (.*)$`)
+	passwordPattern      = regexp.MustCompile(`pam_unix\((?:passwd|chpasswd|newusers):chauthtok\): password changed for (\S+)`)
+	gpasswdAddPattern    = regexp.MustCompile(`^user (\S+) added by (\S+) to group (\S+)`)
+	gpasswdRemovePattern = regexp.MustCompile(`^user (\S+) removed by (\S+) from group (\S+)`)
+	groupModPattern      = regexp.MustCompile(`^group changed in /etc/group \(group ([^/\s]+)/\d+(?:, (.*))?\)`)
+	chagePattern         = regexp.MustCompile(`^changed password expiry for (\S+)`)
+)
+
+func parseAccount(program, msg string) *types.Event {
+	switch program {
+	case "useradd", "userdel", "usermod", "groupadd", "groupdel", "groupmod":
+	case "passwd", "chpasswd", "newusers", "gpasswd", "chage":
+	default:
+		return nil
+	}
+
+	if m := newUserPattern.FindStringSubmatch(msg); m != nil {
+		f := keyValues(m[1])
+		e := accountEvent(types.EventAccountUserAdded, f["name"], "", nil, "user "+f["name"]+" created")
+		for _, k := range []string{"UID", "GID", "home", "shell", "from"} {
+			if f[k] != "" {
+				e.SetMetadata(strings.ToLower(k), f[k])
+			}
+		}
+		return e
+	}
+	if m := newGroupPattern.FindStringSubmatch(msg); m != nil {
+		// useradd logs the user's own group as well; it is still a new group.
+		f := keyValues(m[1])
+		e := accountEvent(types.EventAccountGroupAdded, "", "", []string{f["name"]}, "group "+f["name"]+" created")
+		if f["GID"] != "" {
+			e.SetMetadata("gid", f["GID"])
+		}
+		return e
+	}
+	if m := deleteUserPattern.FindStringSubmatch(msg); m != nil {
+		return accountEvent(types.EventAccountUserDeleted, m[1], "", nil, "user "+m[1]+" deleted")
+	}
+	if m := deleteGroupPattern.FindStringSubmatch(msg); m != nil {
+		group := m[1] + m[2]
+		return accountEvent(types.EventAccountGroupDeleted, "", "", []string{group}, "group "+group+" deleted")
+	}
+	if m := addToGroupPattern.FindStringSubmatch(msg); m != nil {
+		return accountEvent(types.EventAccountGroupMemberAdded, m[1], "", []string{m[2]}, m[1]+" added to group "+m[2])
+	}
+	if m := removeFromGroupPat.FindStringSubmatch(msg); m != nil {
+		return accountEvent(types.EventAccountGroupMemberRemoved, m[1], "", []string{m[2]}, m[1]+" removed from group "+m[2])
+	}
+	if m := gpasswdAddPattern.FindStringSubmatch(msg); m != nil {
+		return accountEvent(types.EventAccountGroupMemberAdded, m[1], m[2], []string{m[3]}, m[1]+" added to group "+m[3]+" by "+m[2])
+	}
+	if m := gpasswdRemovePattern.FindStringSubmatch(msg); m != nil {
+		return accountEvent(types.EventAccountGroupMemberRemoved, m[1], m[2], []string{m[3]}, m[1]+" removed from group "+m[3]+" by "+m[2])
+	}
+	if m := changeUserPattern.FindStringSubmatch(msg); m != nil {
+		change := m[1] + " " + m[3]
+		e := accountEvent(types.EventAccountUserModified, m[2], "", nil, "user "+m[2]+": "+change)
+		e.SetMetadata("change", change)
+		return e
+	}
+	if m := groupModPattern.FindStringSubmatch(msg); m != nil {
+		e := accountEvent(types.EventAccountGroupModified, "", "", []string{m[1]}, "group "+m[1]+" changed")
+		if m[2] != "" {
+			e.SetMetadata("change", m[2])
+		}
+		return e
+	}
+	if m := passwordPattern.FindStringSubmatch(msg); m != nil {
+		return accountEvent(types.EventAccountPasswordChanged, m[1], "", nil, "password changed for "+m[1])
+	}
+	if m := chagePattern.FindStringSubmatch(msg); m != nil {
+		return accountEvent(types.EventAccountExpiryChanged, m[1], "", nil, "password expiry changed for "+m[1])
+	}
+	return nil
+}
+
+func accountEvent(t types.EventType, user, actor string, groups []string, message string) *types.Event {
+	e := &types.Event{
+		EventType: t,
+		Severity:  types.SeverityWarning,
+		Username:  user,
+		Message:   message,
+	}
+	if user != "" {
+		e.SetMetadata("user", user)
+	}
+	if actor != "" {
+		e.SetMetadata("actor", actor)
+	}
+	if len(groups) > 0 {
+		e.SetMetadata("groups", groups)
+	}
+	return e
+}
+
+// keyValues splits "name=bob, UID=1001, home=/home/bob".
+func keyValues(s string) map[string]string {
+	f := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(part), "="); ok {
+			f[k] = v
+		}
+	}
+	return f
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/parser/syslog"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// Parser reads the non-sshd entries of auth.log and secure: privilege
+// changes through sudo and su, and account management. Lines are
+// dispatched on the syslog program name, so it only handles lines that
+// carry a syslog header.
+type Parser struct {
+	serverID string
+}
+
+func New(serverID string) *Parser {
+	return &Parser{serverID: serverID}
+}
+
+func (p *Parser) Parse(line string, ts time.Time) *types.Event {
+	h, ok := syslog.Parse(line, ts)
+	if !ok {
+		return nil
+	}
+
+	var event *types.Event
+	switch h.Program {
+	case "sudo":
+		event = parseSudo(h.Message)
+	case "su", "su-l":
+		event = parseSu(h.Message)
+	default:
+		event = parseAccount(h.Program, h.Message)
+	}
+	if event == nil {
+		return nil
+	}
+
+	event.Timestamp = h.Timestamp
+	event.ServerID = p.serverID
+	event.RawLog = line
+	if h.PID > 0 {
+		event.SetMetadata("pid", h.PID)
+	}
+	return event
+}
+
+// sudoPattern matches the per-command audit line:
+//
+//	alice : TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/apt update
+//	alice : 3 incorrect password attempts ; TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/bin/ls
+var sudoPattern = regexp.MustCompile(`^\s*(\S+) : (.*)$`)
+
+func parseSudo(msg string) *types.Event {
+	m := sudoPattern.FindStringSubmatch(msg)
+	if m == nil {
+		return nil
+	}
+	user := m[1]
+	body := m[2]
+
+	// COMMAND is always last and may itself contain " ; ".
+	command := ""
+	if idx := strings.Index(body, "COMMAND="); idx >= 0 {
+		command = body[idx+len("COMMAND="):]
+		body = strings.TrimSuffix(strings.TrimSpace(body[:idx]), ";")
+	}
+
+	fields := make(map[string]string)
+	reason := ""
+	for _, part := range strings.Split(body, " ; ") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if k, v, ok := strings.Cut(part, "="); ok && k == strings.ToUpper(k) && !strings.Contains(k, " ") {
+			fields[k] = v
+		} else if reason == "" {
+			reason = part
+		}
+	}
+	if command == "" && fields["USER"] == "" {
+		return nil
+	}
+
+	target := fields["USER"]
+	if target == "" {
+		target = "root"
+	}
+
+	event := &types.Event{
+		EventType: types.EventSudoSuccess,
+		Severity:  types.SeverityInfo,
+		Username:  user,
+		Message:   "sudo as " + target + ": " + command,
+		Metadata: map[string]interface{}{
+			"invoking_user": user,
+			"target_user":   target,
+			"command":       command,
+			"tty":           fields["TTY"],
+			"pwd":           fields["PWD"],
+		},
+	}
+	if reason != "" {
+		event.EventType = types.EventSudoFailed
+		event.Severity = types.SeverityWarning
+		event.Message = "sudo denied (" + reason + "): " + command
+		event.SetMetadata("reason", reason)
+	}
+	return event
+}
+
+var (
+	// Debian: "(to root) alice on pts/0"; RHEL: "Successful su for root by alice".
+	suToPattern      = regexp.MustCompile(`^\(to (\S+)\) (\S+) on (\S+)`)
+	suSuccessPattern = regexp.MustCompile(`^Successful su for (\S+) by (\S+)`)
+	// Debian short form: "+ pts/0 alice:root" on success, "- pts/0 alice:root" on failure.
+	suShortPattern  = regexp.MustCompile(`^([+-]) (\S+) (\S+):(\S+)`)
+	suFailedPattern = regexp.MustCompile(`^FAILED (?:SU|su) (?:\(to (\S+)\) (\S+)|for (\S+) by (\S+))(?: on (\S+))?`)
+	// pam_unix(su:session): session opened for user root(uid=0) by alice(uid=1000)
+	suOpenedPattern = regexp.MustCompile(`pam_unix\(su(?:-l)?:session\): session opened for user ([^\s(]+)(?:\(uid=\d+\))? by ([^\s(]*)`)
+	suClosedPattern = regexp.MustCompile(`pam_unix\(su(?:-l)?:session\): session closed for user ([^\s(]+)`)
+	// pam_unix(su:auth): authentication failure; logname=alice uid=1000 euid=0 tty=pts/0 ruser=alice rhost=  user=root
+	suAuthFailPattern = regexp.MustCompile(`pam_unix\(su(?:-l)?:auth\): authentication failure;.*\bruser=(\S*).*\buser=(\S+)`)
+)
+
+func parseSu(msg string) *types.Event {
+	if m := suToPattern.FindStringSubmatch(msg); m != nil {
+		return suEvent(types.EventSuSuccess, m[2], m[1], m[3])
+	}
+	if m := suSuccessPattern.FindStringSubmatch(msg); m != nil {
+		return suEvent(types.EventSuSuccess, m[2], m[1], "")
+	}
+	if m := suShortPattern.FindStringSubmatch(msg); m != nil {
+		if m[1] == "+" {
+			return suEvent(types.EventSuSuccess, m[3], m[4], m[2])
+		}
+		return suEvent(types.EventSuFailed, m[3], m[4], m[2])
+	}
+	if m := suFailedPattern.FindStringSubmatch(msg); m != nil {
+		if m[1] != "" {
+			return suEvent(types.EventSuFailed, m[2], m[1], m[5])
+		}
+		return suEvent(types.EventSuFailed, m[4], m[3], m[5])
+	}
+	if m := suOpenedPattern.FindStringSubmatch(msg); m != nil {
+		return suEvent(types.EventSuSessionOpened, m[2], m[1], "")
+	}
+	if m := suClosedPattern.FindStringSubmatch(msg); m != nil {
+		return suEvent(types.EventSuSessionClosed, "", m[1], "")
+	}
+	if m := suAuthFailPattern.FindStringSubmatch(msg); m != nil {
+		return suEvent(types.EventSuFailed, m[1], m[2], "")
+	}
+	return nil
+}
+
+func suEvent(t types.EventType, user, target, tty string) *types.Event {
+	event := &types.Event{
+		EventType: t,
+		Severity:  types.SeverityInfo,
+		Username:  user,
+		Metadata: map[string]interface{}{
+			"target_user": target,
+		},
+	}
+	if user != "" {
+		event.SetMetadata("invoking_user", user)
+	}
+	if tty != "" {
+		event.SetMetadata("tty", tty)
+	}
+
+	switch t {
+	case types.EventSuSuccess:
+		event.Message = "su to " + target + " by " + user
+	case types.EventSuFailed:
+		event.Severity = types.SeverityWarning
+		event.Message = "su to " + target + " failed for " + user
+	case types.EventSuSessionOpened:
+		event.Message = "su session opened for " + target
+	case types.EventSuSessionClosed:
+		event.Message = "su session closed for " + target
+	}
+	return event
+}
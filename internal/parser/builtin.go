@@ -0,0 +1,53 @@
+package parser
+
+import (
+	"github.com/SdxShadow/Mlog/internal/parser/application"
+	"github.com/SdxShadow/Mlog/internal/parser/audit"
+	"github.com/SdxShadow/Mlog/internal/parser/auth"
+	"github.com/SdxShadow/Mlog/internal/parser/firewall"
+	"github.com/SdxShadow/Mlog/internal/parser/kernel"
+	"github.com/SdxShadow/Mlog/internal/parser/ssh"
+	"github.com/SdxShadow/Mlog/internal/parser/systemd"
+)
+
+func init() {
+	Register("ssh", func(serverID string) Parser {
+		return ssh.New(serverID)
+	})
+	Register("auth", func(serverID string) Parser {
+		return auth.New(serverID)
+	})
+	Register("nginx-access", func(serverID string) Parser {
+		return Func(application.NewNginxParser(serverID).ParseAccess)
+	})
+	Register("nginx-error", func(serverID string) Parser {
+		return Func(application.NewNginxParser(serverID).ParseError)
+	})
+	Register("apache-access", func(serverID string) Parser {
+		return Func(application.NewApacheParser(serverID).ParseAccess)
+	})
+	Register("apache-error", func(serverID string) Parser {
+		return Func(application.NewApacheParser(serverID).ParseError)
+	})
+	Register("caddy-access", func(serverID string) Parser {
+		return Func(application.NewCaddyParser(serverID).ParseAccess)
+	})
+	Register("traefik-access", func(serverID string) Parser {
+		return Func(application.NewTraefikParser(serverID).ParseAccess)
+	})
+	Register("pm2", func(serverID string) Parser {
+		return application.NewPM2Parser(serverID)
+	})
+	Register("firewall", func(serverID string) Parser {
+		return firewall.New(serverID)
+	})
+	Register("kernel", func(serverID string) Parser {
+		return kernel.New(serverID)
+	})
+	Register("audit", func(serverID string) Parser {
+		return audit.New(serverID)
+	})
+	Register("systemd", func(serverID string) Parser {
+		return systemd.New(serverID)
+	})
+}
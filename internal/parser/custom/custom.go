@@ -0,0 +1,276 @@
+// Package custom parses log formats described in the config: a regular
+// expression with named groups, or a grok expression, and a mapping from
+// groups to event fields.
+package custom
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/parser/grok"
+	"github.com/SdxShadow/Mlog/internal/parser/stacktrace"
+	"github.com/SdxShadow/Mlog/internal/parser/timestamp"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// eventFields are the event fields a capture group can be mapped to.
+var eventFields = []string{"timestamp", "source_ip", "dest_ip", "source_port", "username", "severity", "message"}
+
+type Parser struct {
+	serverID   string
+	name       string
+	pattern    *regexp.Regexp
+	types      map[string]string // group -> int or float
+	timeFormat string
+	fields     map[string]string // event field -> group
+	eventType  types.EventType
+	severity   types.Severity
+	rules      []rule
+}
+
+type rule struct {
+	field     string
+	match     *regexp.Regexp
+	severity  types.Severity
+	eventType types.EventType
+}
+
+// New compiles the parser for a custom log source. Groups named after an
+// event field (e.g. (?P<source_ip>...)) are mapped to it unless the config
+// maps the field to another group.
+func New(serverID string, cfg types.CustomLogConfig) (*Parser, error) {
+	var re *regexp.Regexp
+	var groupTypes map[string]string
+	switch {
+	case cfg.Pattern != "" && cfg.Grok != "":
+		return nil, fmt.Errorf("set either pattern or grok, not both")
+	case cfg.Pattern != "":
+		var err error
+		if re, err = regexp.Compile(cfg.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+	case cfg.Grok != "":
+		g, err := grok.Compile(cfg.Grok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grok: %w", err)
+		}
+		re, groupTypes = g.Regexp, g.Types
+	default:
+		return nil, fmt.Errorf("no pattern or grok")
+	}
+
+	p := &Parser{
+		serverID:   serverID,
+		name:       cfg.Name,
+		pattern:    re,
+		types:      groupTypes,
+		timeFormat: cfg.TimeFormat,
+		fields:     make(map[string]string),
+		eventType:  types.EventCustom,
+		severity:   types.SeverityInfo,
+	}
+
+	groups := make(map[string]bool)
+	for _, g := range re.SubexpNames() {
+		if g != "" {
+			groups[g] = true
+		}
+	}
+	for _, f := range eventFields {
+		if groups[f] {
+			p.fields[f] = f
+		}
+	}
+	for field, group := range cfg.Fields {
+		if !isEventField(field) {
+			return nil, fmt.Errorf("unknown event field %q (known: %s)", field, strings.Join(eventFields, ", "))
+		}
+		if !groups[group] {
+			return nil, fmt.Errorf("field %s: pattern has no group %q", field, group)
+		}
+		p.fields[field] = group
+	}
+
+	if cfg.EventType != "" {
+		p.eventType = types.EventType(cfg.EventType)
+	}
+	if cfg.Severity != "" {
+		sev, ok := ParseSeverity(cfg.Severity)
+		if !ok {
+			return nil, fmt.Errorf("unknown severity %q", cfg.Severity)
+		}
+		p.severity = sev
+	}
+
+	for i, rc := range cfg.Rules {
+		if !groups[rc.Field] && !isEventField(rc.Field) {
+			return nil, fmt.Errorf("rule %d: unknown field %q", i+1, rc.Field)
+		}
+		match, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid match: %w", i+1, err)
+		}
+		r := rule{field: rc.Field, match: match, eventType: types.EventType(rc.EventType)}
+		if rc.Severity != "" {
+			if r.severity, _ = ParseSeverity(rc.Severity); r.severity == "" {
+				return nil, fmt.Errorf("rule %d: unknown severity %q", i+1, rc.Severity)
+			}
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// Parse matches the pattern against the first line of an entry. The rest
+// of a multiline entry is kept in RawLog and, when it is a stack trace,
+// summarised in the metadata.
+func (p *Parser) Parse(entry string, ts time.Time) *types.Event {
+	line, _, multi := strings.Cut(entry, "\n")
+	m := p.pattern.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	values := make(map[string]string)
+	for i, g := range p.pattern.SubexpNames() {
+		if g != "" && m[i] != "" {
+			values[g] = m[i]
+		}
+	}
+
+	event := &types.Event{
+		Timestamp: ts,
+		ServerID:  p.serverID,
+		EventType: p.eventType,
+		Severity:  p.severity,
+		Message:   line,
+		RawLog:    entry,
+	}
+	if multi {
+		if trace, ok := stacktrace.Parse(entry); ok {
+			trace.Annotate(event.SetMetadata)
+		}
+	}
+
+	mapped := make(map[string]bool)
+	for field, group := range p.fields {
+		v, ok := values[group]
+		if !ok {
+			continue
+		}
+		mapped[group] = true
+		switch field {
+		case "timestamp":
+			if t, ok := timestamp.Format(v, p.timeFormat, ts); ok {
+				event.Timestamp = t
+			} else {
+				mapped[group] = false
+			}
+		case "source_ip":
+			event.SourceIP = v
+		case "dest_ip":
+			event.DestIP = v
+		case "source_port":
+			event.SourcePort, _ = strconv.Atoi(v)
+		case "username":
+			event.Username = v
+		case "severity":
+			if sev, ok := ParseSeverity(v); ok {
+				event.Severity = sev
+			}
+			// The original level is kept; it is often more specific.
+			mapped[group] = false
+		case "message":
+			event.Message = v
+		}
+	}
+	for g, v := range values {
+		if !mapped[g] {
+			event.SetMetadata(g, p.convert(g, v))
+		}
+	}
+	if p.name != "" {
+		event.SetMetadata("source", p.name)
+	}
+
+	for _, r := range p.rules {
+		if !r.match.MatchString(p.value(event, values, r.field)) {
+			continue
+		}
+		if r.severity != "" {
+			event.Severity = r.severity
+		}
+		if r.eventType != "" {
+			event.EventType = r.eventType
+		}
+		break
+	}
+	return event
+}
+
+// convert applies the :int or :float type of a grok field. Values that do
+// not convert are kept as text.
+func (p *Parser) convert(group, v string) interface{} {
+	switch p.types[group] {
+	case "int":
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// value returns a rule's field: a capture group, or else an event field.
+func (p *Parser) value(e *types.Event, values map[string]string, field string) string {
+	if v, ok := values[field]; ok {
+		return v
+	}
+	switch field {
+	case "source_ip":
+		return e.SourceIP
+	case "dest_ip":
+		return e.DestIP
+	case "source_port":
+		return strconv.Itoa(e.SourcePort)
+	case "username":
+		return e.Username
+	case "severity":
+		return string(e.Severity)
+	case "message":
+		return e.Message
+	}
+	return ""
+}
+
+// ParseSeverity maps the level names used by common logging libraries to
+// a severity, e.g. WARN to warning and FATAL to critical.
+func ParseSeverity(s string) (types.Severity, bool) {
+	switch strings.ToLower(s) {
+	case "trace", "debug", "dbug", "d":
+		return types.SeverityDebug, true
+	case "info", "notice", "information", "i":
+		return types.SeverityInfo, true
+	case "warn", "warning", "wrn", "w":
+		return types.SeverityWarning, true
+	case "error", "err", "eror", "e":
+		return types.SeverityError, true
+	case "fatal", "critical", "crit", "panic", "alert", "emerg", "emergency", "dpanic", "f":
+		return types.SeverityCritical, true
+	}
+	return "", false
+}
+
+func isEventField(f string) bool {
+	for _, ef := range eventFields {
+		if f == ef {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package firewall
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/parser/syslog"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// Parser reads packet log lines written by the kernel for UFW, iptables
+// and nftables LOG rules, e.g.
+//
+//	kernel: [UFW BLOCK] IN=eth0 OUT= MAC=... SRC=1.2.3.4 DST=10.0.0.1 ... PROTO=TCP SPT=51234 DPT=22 ...
+type Parser struct {
+	serverID string
+}
+
+func New(serverID string) *Parser {
+	return &Parser{serverID: serverID}
+}
+
+func (p *Parser) Parse(line string, ts time.Time) *types.Event {
+	if !strings.Contains(line, "SRC=") || !strings.Contains(line, "DST=") {
+		return nil
+	}
+
+	msg := line
+	if h, ok := syslog.Parse(line, ts); ok {
+		ts = h.Timestamp
+		msg = h.Message
+	}
+
+	idx := strings.Index(msg, "IN=")
+	if idx < 0 {
+		return nil
+	}
+	prefix := logPrefix(msg[:idx])
+	fields := parseFields(msg[idx:])
+
+	src, dst := fields["SRC"], fields["DST"]
+	if src == "" || dst == "" {
+		return nil
+	}
+	proto := fields["PROTO"]
+	spt, _ := strconv.Atoi(fields["SPT"])
+	dpt, _ := strconv.Atoi(fields["DPT"])
+
+	action := actionOf(prefix)
+	eventType := types.EventFirewallLog
+	switch action {
+	case "block":
+		eventType = types.EventFirewallBlock
+	case "allow":
+		eventType = types.EventFirewallAllow
+	}
+
+	message := fmt.Sprintf("%s %s %s -> %s", prefix, proto, src, dst)
+	if dpt > 0 {
+		message += ":" + strconv.Itoa(dpt)
+	}
+
+	metadata := map[string]interface{}{
+		"prefix": prefix,
+		"action": action,
+		"proto":  proto,
+		"in":     fields["IN"],
+	}
+	if dpt > 0 {
+		metadata["dst_port"] = dpt
+	}
+
+	return &types.Event{
+		Timestamp:  ts,
+		ServerID:   p.serverID,
+		EventType:  eventType,
+		Severity:   types.SeverityInfo,
+		SourceIP:   src,
+		DestIP:     dst,
+		SourcePort: spt,
+		Message:    strings.TrimSpace(message),
+		RawLog:     line,
+		Metadata:   metadata,
+	}
+}
+
+// logPrefix returns the rule's --log-prefix, dropping the kernel uptime
+// stamp that some setups leave in front of it.
+func logPrefix(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		if end := strings.Index(s, "]"); end > 0 {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(s[1:end]), 64); err == nil {
+				s = strings.TrimSpace(s[end+1:])
+			}
+		}
+	}
+	return strings.Trim(s, "[]: ")
+}
+
+func actionOf(prefix string) string {
+	p := strings.ToUpper(prefix)
+	switch {
+	case strings.Contains(p, "BLOCK"), strings.Contains(p, "DROP"), strings.Contains(p, "REJECT"), strings.Contains(p, "DENY"):
+		return "block"
+	case strings.Contains(p, "ALLOW"), strings.Contains(p, "ACCEPT"):
+		return "allow"
+	}
+	return "log"
+}
+
+// parseFields splits the KEY=value list of a packet log. Flags without a
+// value, such as SYN or DF, are recorded with an empty value.
+func parseFields(s string) map[string]string {
+	fields := make(map[string]string)
+	for _, tok := range strings.Fields(s) {
+		if k, v, ok := strings.Cut(tok, "="); ok {
+			if _, seen := fields[k]; !seen {
+				fields[k] = v
+			}
+		} else {
+			fields[tok] = ""
+		}
+	}
+	return fields
+}
@@ -0,0 +1,187 @@
+// Package grok compiles grok expressions such as
+// "%{IP:client} %{WORD:method} %{URIPATHPARAM:uri}" into regular
+// expressions, using the standard pattern library and any pattern files
+// loaded from the config.
+package grok
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Pattern is a compiled grok expression. Types holds the conversions
+// requested with %{NAME:field:int} or %{NAME:field:float}, by group name.
+type Pattern struct {
+	*regexp.Regexp
+	Types map[string]string
+}
+
+// maxDepth bounds pattern nesting, which also catches reference cycles.
+const maxDepth = 32
+
+var reference = regexp.MustCompile(`%\{(\w+)(?::([\w.@\[\]-]+))?(?::(\w+))?\}`)
+
+var (
+	mu       sync.Mutex
+	patterns = make(map[string]string)
+	cache    = make(map[string]*Pattern)
+)
+
+func init() {
+	for name, p := range builtin {
+		patterns[name] = p
+	}
+}
+
+// Add defines or replaces a pattern.
+func Add(name, pattern string) {
+	mu.Lock()
+	defer mu.Unlock()
+	patterns[name] = pattern
+	cache = make(map[string]*Pattern)
+}
+
+// LoadFiles reads pattern files in the usual grok format, one
+// "NAME pattern" per line with # comments. A directory loads every file in
+// it.
+func LoadFiles(paths []string) error {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if err := loadFile(path); err != nil {
+				return err
+			}
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			if err := loadFile(filepath.Join(path, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, pattern, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected NAME pattern", path, n)
+		}
+		Add(name, strings.TrimSpace(pattern))
+	}
+	return scanner.Err()
+}
+
+// Compile turns a grok expression into a regular expression. Results are
+// cached, so compiling the same expression again is cheap.
+func Compile(expr string) (*Pattern, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if p, ok := cache[expr]; ok {
+		return p, nil
+	}
+
+	types := make(map[string]string)
+	src, err := expand(expr, types, 0)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression: %w", err)
+	}
+	p := &Pattern{Regexp: re, Types: types}
+	cache[expr] = p
+	return p, nil
+}
+
+// expand replaces every %{...} reference in expr with its definition.
+// Named references become capture groups, the others plain groups.
+func expand(expr string, types map[string]string, depth int) (string, error) {
+	if depth > maxDepth {
+		return "", fmt.Errorf("patterns nested too deeply, is there a cycle?")
+	}
+
+	var err error
+	out := reference.ReplaceAllStringFunc(expr, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		m := reference.FindStringSubmatch(ref)
+		name, field, typ := m[1], m[2], m[3]
+
+		def, ok := patterns[name]
+		if !ok {
+			err = fmt.Errorf("unknown grok pattern %q", name)
+			return ""
+		}
+		inner, e := expand(def, types, depth+1)
+		if e != nil {
+			err = e
+			return ""
+		}
+
+		if field == "" {
+			return "(?:" + inner + ")"
+		}
+		group := groupName(field)
+		switch typ {
+		case "":
+		case "int", "float":
+			types[group] = typ
+		default:
+			err = fmt.Errorf("%s: unknown type %q (int or float)", ref, typ)
+			return ""
+		}
+		return "(?P<" + group + ">" + inner + ")"
+	})
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// groupName makes a field name usable as a capture group name, e.g.
+// "[client][ip]" or "client.ip" becomes "client_ip".
+func groupName(field string) string {
+	var b strings.Builder
+	for _, r := range field {
+		switch {
+		case r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
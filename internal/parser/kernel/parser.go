@@ -0,0 +1,230 @@
+package kernel
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/parser/syslog"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// Parser reads the kernel messages worth an alert from kern.log, messages
+// or /dev/kmsg: OOM kills, segfaults, hung tasks, filesystem errors and
+// disk I/O errors. Lines without a syslog header are read as the bare
+// message, as /dev/kmsg has them.
+type Parser struct {
+	serverID string
+}
+
+func New(serverID string) *Parser {
+	return &Parser{serverID: serverID}
+}
+
+var (
+	// Out of memory: Killed process 4242 (node) total-vm:1843560kB, anon-rss:912340kB, file-rss:0kB, shmem-rss:0kB, UID:1000 pgtables:2400kB oom_score_adj:0
+	// Memory cgroup out of memory: Killed process 4242 (node) ...
+	oomPattern = regexp.MustCompile(`(?:Out of memory|out of memory)(?: \(oom_kill_allocating_task\))?: Kill(?:ed)? process (\d+) \(([^)]*)\)(.*)$`)
+	// Older kernels log the kill on a line of its own.
+	oomKilledPattern = regexp.MustCompile(`^Killed process (\d+) \(([^)]*)\)(.*)$`)
+	oomFieldPattern  = regexp.MustCompile(`(total-vm|anon-rss|file-rss|shmem-rss|UID|oom_score_adj):(-?\d+)`)
+
+	// node[4242]: segfault at 0 ip 00007f1c2a4b5c80 sp 00007ffd5e8a2f48 error 4 in libc.so.6[7f1c2a400000+195000]
+	segfaultPattern = regexp.MustCompile(`^(\S+?)\[(\d+)\]: segfault at (\S+) ip (\S+) sp (\S+) error (\d+)(?: in ([^\[\s]+))?`)
+	// traps: node[4242] general protection fault ip:55d0c8a1f2b0 sp:7ffd5e8a2f48 error:0 in node[55d0c8000000+2f00000]
+	trapPattern = regexp.MustCompile(`^traps: (\S+?)\[(\d+)\] (general protection fault|trap \S+(?: \S+)?) ip:(\S+) sp:(\S+) error:(\d+)(?: in ([^\[\s]+))?`)
+
+	// INFO: task jbd2/sda1-8:312 blocked for more than 120 seconds.
+	hungTaskPattern = regexp.MustCompile(`^INFO: task (.+):(\d+) blocked for more than (\d+) seconds`)
+
+	// EXT4-fs error (device sda1): ext4_find_entry:1455: inode #2: comm ls: reading directory lblock 0
+	// BTRFS error (device sda2): bdev /dev/sda2 errs: wr 0, rd 1, flush 0, corrupt 0, gen 0
+	// XFS (sdb1): Corruption detected. Unmount and run xfs_repair
+	// EXT4-fs (sda1): Remounting filesystem read-only
+	fsErrorPattern = regexp.MustCompile(`^(EXT[234]-fs|BTRFS|XFS|F2FS-fs) (?:(error|critical|warning) )?\((?:device )?([^)]+)\):? (.*)$`)
+	fsCommPattern  = regexp.MustCompile(`\bcomm (\S+?):`)
+
+	// blk_update_request: I/O error, dev sda, sector 123456 op 0x0:(READ) flags 0x0 phys_seg 1 prio class 0
+	// I/O error, dev nvme0n1, sector 8 op 0x1:(WRITE) flags 0x800 phys_seg 1 prio class 2
+	// critical medium error, dev sdb, sector 2048 op 0x0:(READ) ...
+	ioErrorPattern = regexp.MustCompile(`(I/O error|critical medium error|critical target error), dev (\S+?), sector (\d+)(?: op \S+:\((\w+)\))?`)
+	// Buffer I/O error on dev sda1, logical block 0, async page read
+	bufferIOPattern = regexp.MustCompile(`^Buffer I/O error on (?:dev|device) (\S+?), logical block (\d+)`)
+
+	// The "[  123.456789] " uptime stamp some setups keep in kern.log.
+	uptimePattern = regexp.MustCompile(`^\[\s*\d+\.\d+\]\s*`)
+)
+
+func (p *Parser) Parse(line string, ts time.Time) *types.Event {
+	msg := line
+	if h, ok := syslog.Parse(line, ts); ok {
+		if h.Program != "kernel" {
+			return nil
+		}
+		ts = h.Timestamp
+		msg = h.Message
+	}
+	msg = uptimePattern.ReplaceAllString(msg, "")
+
+	event := parseMessage(msg)
+	if event == nil {
+		return nil
+	}
+	event.Timestamp = ts
+	event.ServerID = p.serverID
+	event.RawLog = line
+	return event
+}
+
+func parseMessage(msg string) *types.Event {
+	if m := oomPattern.FindStringSubmatch(msg); m != nil {
+		return oomKill(m[1], m[2], m[3], strings.HasPrefix(msg, "Memory cgroup"))
+	}
+	if m := oomKilledPattern.FindStringSubmatch(msg); m != nil {
+		return oomKill(m[1], m[2], m[3], false)
+	}
+
+	if m := segfaultPattern.FindStringSubmatch(msg); m != nil {
+		e := process(types.EventKernelSegfault, types.SeverityError, m[1], m[2])
+		e.Message = m[1] + "[" + m[2] + "] segfault at " + m[3]
+		e.SetMetadata("fault", "segfault")
+		e.SetMetadata("address", m[3])
+		e.SetMetadata("ip", m[4])
+		e.SetMetadata("error", m[6])
+		if m[7] != "" {
+			e.Message += " in " + m[7]
+			e.SetMetadata("object", m[7])
+		}
+		return e
+	}
+	if m := trapPattern.FindStringSubmatch(msg); m != nil {
+		e := process(types.EventKernelSegfault, types.SeverityError, m[1], m[2])
+		e.Message = m[1] + "[" + m[2] + "] " + m[3]
+		e.SetMetadata("fault", m[3])
+		e.SetMetadata("ip", m[4])
+		e.SetMetadata("error", m[6])
+		if m[7] != "" {
+			e.Message += " in " + m[7]
+			e.SetMetadata("object", m[7])
+		}
+		return e
+	}
+
+	if m := hungTaskPattern.FindStringSubmatch(msg); m != nil {
+		e := process(types.EventKernelHungTask, types.SeverityWarning, m[1], m[2])
+		e.Message = "task " + m[1] + ":" + m[2] + " blocked for more than " + m[3] + " seconds"
+		secs, _ := strconv.Atoi(m[3])
+		e.SetMetadata("blocked_seconds", secs)
+		return e
+	}
+
+	if m := fsErrorPattern.FindStringSubmatch(msg); m != nil {
+		return fsError(m[1], m[2], m[3], m[4])
+	}
+
+	if m := ioErrorPattern.FindStringSubmatch(msg); m != nil {
+		e := &types.Event{
+			EventType: types.EventKernelIOError,
+			Severity:  types.SeverityError,
+			Message:   m[1] + " on " + m[2] + ", sector " + m[3],
+		}
+		e.SetMetadata("device", m[2])
+		sector, _ := strconv.ParseInt(m[3], 10, 64)
+		e.SetMetadata("sector", sector)
+		if m[4] != "" {
+			e.SetMetadata("op", m[4])
+		}
+		return e
+	}
+	if m := bufferIOPattern.FindStringSubmatch(msg); m != nil {
+		e := &types.Event{
+			EventType: types.EventKernelIOError,
+			Severity:  types.SeverityError,
+			Message:   "Buffer I/O error on " + m[1] + ", logical block " + m[2],
+		}
+		e.SetMetadata("device", m[1])
+		block, _ := strconv.ParseInt(m[2], 10, 64)
+		e.SetMetadata("block", block)
+		return e
+	}
+	return nil
+}
+
+func oomKill(pid, comm, rest string, cgroup bool) *types.Event {
+	e := process(types.EventKernelOOMKill, types.SeverityCritical, comm, pid)
+	e.Message = "OOM killer killed " + comm + "[" + pid + "]"
+	for _, f := range oomFieldPattern.FindAllStringSubmatch(rest, -1) {
+		n, _ := strconv.ParseInt(f[2], 10, 64)
+		switch f[1] {
+		case "total-vm":
+			e.SetMetadata("total_vm_kb", n)
+		case "anon-rss":
+			e.SetMetadata("anon_rss_kb", n)
+			e.Message += ", rss " + strconv.FormatInt(n/1024, 10) + " MB"
+		case "file-rss":
+			e.SetMetadata("file_rss_kb", n)
+		case "shmem-rss":
+			e.SetMetadata("shmem_rss_kb", n)
+		case "UID":
+			e.SetMetadata("uid", n)
+		case "oom_score_adj":
+			e.SetMetadata("oom_score_adj", n)
+		}
+	}
+	if cgroup {
+		e.SetMetadata("constraint", "memcg")
+	}
+	return e
+}
+
+func fsError(fs, level, device, detail string) *types.Event {
+	lower := strings.ToLower(detail)
+	// The mount options logged at every mount, such as
+	// "Opts: errors=remount-ro", are not errors.
+	if i := strings.Index(lower, "opts:"); i >= 0 {
+		lower = lower[:i]
+	}
+	readOnly := strings.Contains(lower, "read-only")
+	switch {
+	case readOnly:
+	case level == "error" || level == "critical":
+	case fs == "XFS" && (strings.Contains(lower, "corruption") || strings.Contains(lower, "metadata i/o error") || strings.Contains(lower, "shutdown")):
+	case strings.Contains(lower, "error"):
+	default:
+		// Mounts, journal recovery and the like.
+		return nil
+	}
+
+	fs = strings.TrimSuffix(fs, "-fs")
+	e := &types.Event{
+		EventType: types.EventKernelFSError,
+		Severity:  types.SeverityError,
+		Message:   fs + " error on " + device + ": " + detail,
+	}
+	if readOnly {
+		// Writes fail from here on until the filesystem is repaired.
+		e.Severity = types.SeverityCritical
+		e.SetMetadata("read_only", true)
+	}
+	e.SetMetadata("fs", fs)
+	e.SetMetadata("device", device)
+	if m := fsCommPattern.FindStringSubmatch(detail); m != nil {
+		e.SetMetadata("process", m[1])
+	}
+	return e
+}
+
+// process starts an event about a process, with its name and pid in the
+// metadata.
+func process(eventType types.EventType, severity types.Severity, comm, pid string) *types.Event {
+	e := &types.Event{
+		EventType: eventType,
+		Severity:  severity,
+	}
+	e.SetMetadata("process", comm)
+	if n, err := strconv.Atoi(pid); err == nil {
+		e.SetMetadata("pid", n)
+	}
+	return e
+}
@@ -0,0 +1,153 @@
+// Package multiline joins log entries that span several lines, such as
+// stack traces, before they are parsed.
+package multiline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// NodeContinuation matches the frame lines of a Node.js stack trace, with
+// or without the timestamp PM2 prepends when started with --time.
+const NodeContinuation = `^(?:\d{4}-\d{2}-\d{2}[T ][0-9:.]+(?: ?(?:Z|[+-]\d{2}:?\d{2}))?:?)?\s+at\s`
+
+const (
+	defaultMaxLines = 500
+	defaultTimeout  = time.Second
+)
+
+// Rule decides which lines belong to the entry before them. A line is a
+// continuation when it matches the continuation pattern, or when a start
+// pattern is set and the line does not match it. A rule made by Group
+// instead joins lines that share a key.
+type Rule struct {
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	key          *regexp.Regexp
+	maxLines     int
+	timeout      time.Duration
+}
+
+// Compile builds a rule from the config. It returns nil without an error
+// when neither pattern is set, i.e. the source is single-line.
+func Compile(cfg types.MultilineConfig) (*Rule, error) {
+	if cfg.Start == "" && cfg.Continuation == "" {
+		return nil, nil
+	}
+
+	r := &Rule{maxLines: cfg.MaxLines, timeout: defaultTimeout}
+	var err error
+	if cfg.Start != "" {
+		if r.start, err = regexp.Compile(cfg.Start); err != nil {
+			return nil, fmt.Errorf("invalid multiline start: %w", err)
+		}
+	}
+	if cfg.Continuation != "" {
+		if r.continuation, err = regexp.Compile(cfg.Continuation); err != nil {
+			return nil, fmt.Errorf("invalid multiline continuation: %w", err)
+		}
+	}
+	if r.maxLines <= 0 {
+		r.maxLines = defaultMaxLines
+	}
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid multiline timeout %q", cfg.Timeout)
+		}
+		r.timeout = d
+	}
+	return r, nil
+}
+
+// Group builds a rule that joins consecutive lines with the same key, the
+// first submatch of key, such as the event id of auditd records. Lines
+// without a key are entries of their own.
+func Group(key *regexp.Regexp, timeout time.Duration) *Rule {
+	return &Rule{key: key, maxLines: defaultMaxLines, timeout: timeout}
+}
+
+func (r *Rule) keyOf(line string) string {
+	if m := r.key.FindStringSubmatch(line); len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
+
+func (r *Rule) continues(line string) bool {
+	if r.continuation != nil && r.continuation.MatchString(line) {
+		return true
+	}
+	return r.start != nil && !r.start.MatchString(line)
+}
+
+// Assembler collects the lines of one file into entries. An entry is
+// complete when the next entry starts, when it reaches the line limit, or
+// when no line has been added for the rule's timeout.
+type Assembler struct {
+	rule   *Rule
+	lines  []string
+	key    string
+	offset int64
+	last   time.Time
+}
+
+func NewAssembler(r *Rule) *Assembler {
+	return &Assembler{rule: r}
+}
+
+// Add takes the next line of the file, read at offset. It returns the
+// entry this line completed, if any.
+func (a *Assembler) Add(line string, offset int64, now time.Time) (string, bool) {
+	if len(a.lines) > 0 && a.continues(line) {
+		a.lines = append(a.lines, line)
+		a.last = now
+		if len(a.lines) >= a.rule.maxLines {
+			return a.Flush()
+		}
+		return "", false
+	}
+
+	entry, ok := a.Flush()
+	a.lines = append(a.lines, line)
+	if a.rule.key != nil {
+		a.key = a.rule.keyOf(line)
+	}
+	a.offset = offset
+	a.last = now
+	return entry, ok
+}
+
+func (a *Assembler) continues(line string) bool {
+	if a.rule.key != nil {
+		k := a.rule.keyOf(line)
+		return k != "" && k == a.key
+	}
+	return a.rule.continues(line)
+}
+
+// Flush returns the buffered entry, if any, and empties the buffer.
+func (a *Assembler) Flush() (string, bool) {
+	if len(a.lines) == 0 {
+		return "", false
+	}
+	entry := strings.Join(a.lines, "\n")
+	a.lines = a.lines[:0]
+	return entry, true
+}
+
+// Pending returns the file offset of the buffered entry. A checkpoint must
+// not go past it, or the entry would be lost on restart.
+func (a *Assembler) Pending() (int64, bool) {
+	return a.offset, len(a.lines) > 0
+}
+
+// Expired reports whether the buffered entry has waited long enough for
+// more lines.
+func (a *Assembler) Expired(now time.Time) bool {
+	return len(a.lines) > 0 && now.Sub(a.last) >= a.rule.timeout
+}
@@ -0,0 +1,136 @@
+// Package parser holds the registry of log parsers. Each log source names
+// the parser that reads it; the watcher looks the name up here instead of
+// guessing from the file path.
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/parser/multiline"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// Parser turns one log line into an event, or nil when the line is not of
+// interest. ts is the time the line was read; parsers prefer the time in
+// the line itself.
+type Parser interface {
+	Parse(line string, ts time.Time) *types.Event
+}
+
+// Func adapts a parse method such as NginxParser.ParseAccess to Parser.
+type Func func(line string, ts time.Time) *types.Event
+
+func (f Func) Parse(line string, ts time.Time) *types.Event {
+	return f(line, ts)
+}
+
+// Chain tries each parser in turn and returns the first event. It lets
+// several parsers share a file, as sshd and sudo share auth.log.
+type Chain []Parser
+
+func (c Chain) Parse(line string, ts time.Time) *types.Event {
+	for _, p := range c {
+		if event := p.Parse(line, ts); event != nil {
+			return event
+		}
+	}
+	return nil
+}
+
+// Multiliner is implemented by parsers whose entries span several lines in
+// a way of their own, such as auditd events made of several records. The
+// watcher uses the rule unless the source configures one.
+type Multiliner interface {
+	Multiline() *multiline.Rule
+}
+
+// MultilineRule returns the rule of p, or of the first parser in a chain
+// that has one.
+func MultilineRule(p Parser) *multiline.Rule {
+	switch p := p.(type) {
+	case Multiliner:
+		return p.Multiline()
+	case Chain:
+		for _, q := range p {
+			if r := MultilineRule(q); r != nil {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// Factory creates a parser for the given server.
+type Factory func(serverID string) Parser
+
+var registry = make(map[string]Factory)
+
+// Register makes a parser available under name. It panics when the name is
+// taken, since that can only be a programming error.
+func Register(name string, f Factory) {
+	if _, ok := registry[name]; ok {
+		panic("parser: " + name + " registered twice")
+	}
+	registry[name] = f
+}
+
+// New creates the parser registered under name.
+func New(name, serverID string) (Parser, error) {
+	f, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown parser %q (known: %s)", name, strings.Join(Names(), ", "))
+	}
+	return f(serverID), nil
+}
+
+// Names lists the registered parsers in alphabetical order.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Exists reports whether a parser is registered under name.
+func Exists(name string) bool {
+	_, ok := registry[name]
+	return ok
+}
+
+// detectRules map the default locations of the supported logs to their
+// parsers. They are only used for sources that do not name a parser.
+var detectRules = []struct {
+	subs    []string
+	parsers []string
+}{
+	{[]string{"/var/log/auth.log", "/var/log/secure"}, []string{"auth", "ssh"}},
+	{[]string{"/nginx/access.log"}, []string{"nginx-access"}},
+	{[]string{"/nginx/error.log"}, []string{"nginx-error"}},
+	{[]string{"/apache2/access.log", "/httpd/access_log"}, []string{"apache-access"}},
+	{[]string{"/apache2/error.log", "/httpd/error_log"}, []string{"apache-error"}},
+	{[]string{"/caddy/access.log"}, []string{"caddy-access"}},
+	{[]string{"/traefik/access.log"}, []string{"traefik-access"}},
+	{[]string{"/.pm2/logs/", "pm2.log"}, []string{"pm2"}},
+	{[]string{"/var/log/syslog", "/var/log/messages"}, []string{"systemd", "kernel", "firewall"}},
+	{[]string{"/var/log/kern.log"}, []string{"kernel", "firewall"}},
+	{[]string{"/var/log/ufw.log"}, []string{"firewall"}},
+	{[]string{"/var/log/audit/"}, []string{"audit"}},
+}
+
+// Detect guesses the parsers for a file from its path. It returns nil when
+// the path is not one of the well-known log locations.
+func Detect(path string) []string {
+	for _, r := range detectRules {
+		for _, sub := range r.subs {
+			if strings.Contains(path, sub) {
+				return r.parsers
+			}
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"regexp"
 	"time"
 
+	"github.com/SdxShadow/Mlog/internal/parser/syslog"
 	"github.com/SdxShadow/Mlog/pkg/types"
 )
 
@@ -22,7 +23,7 @@ type pattern struct {
 
 var patterns = []pattern{
 	{
-		regexp.MustCompile(`Accepted (password|publickey) for (\S+) from (\S+) port (\d+)`),
+		regexp.MustCompile(`Accepted (\S+) for (\S+) from (\S+) port (\d+)`),
 		func(m []string, raw string) *types.Event {
 			return &types.Event{
 				EventType:   types.EventSSHConnected,
@@ -32,6 +33,9 @@ var patterns = []pattern{
 				SourcePort:  toInt(m[4]),
 				Message:     "SSH login successful",
 				RawLog:      raw,
+				Metadata: map[string]interface{}{
+					"auth_method": m[1],
+				},
 			}
 		},
 	},
@@ -63,6 +67,32 @@ var patterns = []pattern{
 			}
 		},
 	},
+	{
+		regexp.MustCompile(`Disconnected from user (\S+) (\S+) port (\d+)$`),
+		func(m []string, raw string) *types.Event {
+			return &types.Event{
+				EventType:   types.EventSSHDisconnected,
+				Severity:    types.SeverityInfo,
+				Username:    m[1],
+				SourceIP:    m[2],
+				SourcePort:  toInt(m[3]),
+				Message:     "SSH disconnected",
+				RawLog:      raw,
+			}
+		},
+	},
+	{
+		regexp.MustCompile(`pam_unix\(sshd:session\): session closed for user (\S+)`),
+		func(m []string, raw string) *types.Event {
+			return &types.Event{
+				EventType:   types.EventSSHDisconnected,
+				Severity:    types.SeverityInfo,
+				Username:    m[1],
+				Message:     "SSH session closed",
+				RawLog:      raw,
+			}
+		},
+	},
 	{
 		regexp.MustCompile(`Disconnected from user (\S+) \[preauth\]`),
 		func(m []string, raw string) *types.Event {
@@ -102,13 +132,27 @@ var patterns = []pattern{
 	},
 }
 
+// Parse matches sshd messages. The event time comes from the syslog
+// header when there is one, and falls back to ts otherwise.
+//
+// The sshd PID from the header is kept as "pid" metadata; it ties the
+// login to the session close logged later by the same process.
 func (p *Parser) Parse(line string, ts time.Time) *types.Event {
+	pid := 0
+	if h, ok := syslog.Parse(line, ts); ok {
+		ts = h.Timestamp
+		pid = h.PID
+	}
+
 	for _, pat := range patterns {
 		m := pat.regex.FindStringSubmatch(line)
 		if len(m) > 0 {
-			event := pat.handler(m[1:], line)
+			event := pat.handler(m, line)
 			event.Timestamp = ts
 			event.ServerID = p.serverID
+			if pid > 0 {
+				event.SetMetadata("pid", pid)
+			}
 			return event
 		}
 	}
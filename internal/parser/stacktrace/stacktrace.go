@@ -0,0 +1,109 @@
+// Package stacktrace pulls the error class and the frame that raised it
+// out of Node.js, Java and Python stack traces.
+package stacktrace
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Trace summarises a stack trace.
+type Trace struct {
+	Class    string // e.g. TypeError, java.lang.NullPointerException
+	Message  string
+	TopFrame string // where the error was raised
+	Frames   int
+}
+
+var (
+	// A JavaScript or Java exception line, e.g. "TypeError: x is undefined"
+	// or `Exception in thread "main" java.lang.IllegalStateException: boom`.
+	headerPattern = regexp.MustCompile(`^(?:Uncaught |Exception in thread "[^"]*" |Caused by: )?([A-Za-z_$][\w$]*(?:\.[A-Za-z_$][\w$]*)*(?:Error|Exception|Throwable|Fault))(?::\s*(.*))?$`)
+	// "at foo (/app/index.js:10:5)" or "at com.example.Foo.bar(Foo.java:42)"
+	framePattern = regexp.MustCompile(`^at (.+)$`)
+
+	pythonStart = "Traceback (most recent call last):"
+	// File "/app/main.py", line 10, in handler
+	pythonFrame = regexp.MustCompile(`^File "([^"]+)", line (\d+), in (.+)$`)
+	// The last line of a Python traceback: "ValueError: bad value" or
+	// "requests.exceptions.ConnectionError: ...".
+	pythonError = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?::\s*(.*))?$`)
+)
+
+// Parse looks for a stack trace in a multiline log entry. It reports false
+// when the entry does not contain one.
+func Parse(text string) (*Trace, bool) {
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	for i, line := range lines {
+		if strings.HasSuffix(line, pythonStart) {
+			return parsePython(lines[i+1:])
+		}
+	}
+	return parseFrames(lines)
+}
+
+// parseFrames handles the JavaScript and Java layout: the exception line
+// first, then one "at" line per frame, innermost first.
+func parseFrames(lines []string) (*Trace, bool) {
+	var t *Trace
+	for _, line := range lines {
+		if t == nil {
+			if m := headerPattern.FindStringSubmatch(line); m != nil {
+				t = &Trace{Class: m[1], Message: m[2]}
+			}
+			continue
+		}
+		if m := framePattern.FindStringSubmatch(line); m != nil {
+			if t.Frames == 0 {
+				t.TopFrame = m[1]
+			}
+			t.Frames++
+		}
+	}
+	if t == nil || t.Frames == 0 {
+		return nil, false
+	}
+	return t, true
+}
+
+// parsePython handles tracebacks, which list frames outermost first and
+// end with the exception.
+func parsePython(lines []string) (*Trace, bool) {
+	t := &Trace{}
+	for _, line := range lines {
+		if m := pythonFrame.FindStringSubmatch(line); m != nil {
+			t.TopFrame = m[3] + " (" + m[1] + ":" + m[2] + ")"
+			t.Frames++
+			continue
+		}
+		if t.Frames == 0 || line == "" {
+			continue
+		}
+		// Source lines follow each frame; the exception is the last line
+		// that looks like one.
+		if m := pythonError.FindStringSubmatch(line); m != nil {
+			t.Class, t.Message = m[1], m[2]
+		}
+	}
+	if t.Class == "" {
+		return nil, false
+	}
+	return t, true
+}
+
+// Annotate stores a trace in event metadata under error_class,
+// error_message, top_frame and frames.
+func (t *Trace) Annotate(set func(key string, value interface{})) {
+	set("error_class", t.Class)
+	if t.Message != "" {
+		set("error_message", t.Message)
+	}
+	if t.TopFrame != "" {
+		set("top_frame", t.TopFrame)
+	}
+	set("frames", t.Frames)
+}
@@ -0,0 +1,50 @@
+package syslog
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/parser/timestamp"
+)
+
+// Header is the prefix rsyslog writes in front of every message in files
+// such as auth.log, secure, syslog and kern.log.
+type Header struct {
+	Timestamp time.Time
+	Host      string
+	Program   string
+	PID       int
+	Message   string
+}
+
+var headerPattern = regexp.MustCompile(`^(?:([A-Z][a-z]{2}\s+\d{1,2}\s+\d{2}:\d{2}:\d{2})|(\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2})))\s+(\S+)\s+([^\s\[:]+)(?:\[(\d+)\])?:\s?(.*)$`)
+
+// Parse splits a syslog line into its header fields. Classic timestamps
+// get their year from ref, normally the time the line was read.
+func Parse(line string, ref time.Time) (*Header, bool) {
+	m := headerPattern.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+
+	h := &Header{
+		Host:    m[3],
+		Program: m[4],
+		Message: m[6],
+	}
+	if m[5] != "" {
+		h.PID, _ = strconv.Atoi(m[5])
+	}
+
+	var ok bool
+	if m[1] != "" {
+		h.Timestamp, ok = timestamp.Syslog(m[1], ref)
+	} else {
+		h.Timestamp, ok = timestamp.RFC3339(m[2])
+	}
+	if !ok {
+		h.Timestamp = ref
+	}
+	return h, true
+}
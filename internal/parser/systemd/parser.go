@@ -0,0 +1,160 @@
+package systemd
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SdxShadow/Mlog/internal/parser/syslog"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// Parser reads the unit lifecycle messages systemd writes to syslog and
+// messages, e.g.
+//
+//	systemd[1]: Started nginx.service - A high performance web server and a reverse proxy server.
+//	systemd[1]: nginx.service: Main process exited, code=exited, status=1/FAILURE
+//	systemd[1]: nginx.service: Failed with result 'exit-code'.
+//	systemd[1]: nginx.service: Scheduled restart job, restart counter is at 3.
+//	systemd[1]: nginx.service: Start request repeated too quickly.
+//
+// Before systemd 250, Started, Stopped and "Failed to start" name the
+// unit's description rather than the unit, so those events only carry the
+// description.
+type Parser struct {
+	serverID string
+}
+
+func New(serverID string) *Parser {
+	return &Parser{serverID: serverID}
+}
+
+var (
+	// A unit name followed by a description, as in "nginx.service - nginx".
+	unitDescPattern = regexp.MustCompile(`^(\S+\.(?:service|socket|mount|timer|path|swap|automount)) - (.*?)\.?$`)
+	// "<unit>: <message>".
+	unitMsgPattern = regexp.MustCompile(`^(\S+\.(?:service|socket|mount|timer|path|swap|automount|scope)): (.*)$`)
+
+	exitPattern    = regexp.MustCompile(`^Main process exited, code=(\w+), status=(\S+?)$`)
+	resultPattern  = regexp.MustCompile(`^Failed with result '([^']+)'\.?$`)
+	restartPattern = regexp.MustCompile(`^Scheduled restart job, restart counter is at (\d+)\.?$`)
+	// Unit failures as older versions word them.
+	legacyFailPattern = regexp.MustCompile(`^(?:Unit )?(\S+\.service) (?:entered failed state|failed)\.?$`)
+
+	// Session scopes are started and stopped for every login.
+	sessionPattern = regexp.MustCompile(`^Session \S+ of [Uu]ser `)
+)
+
+func (p *Parser) Parse(line string, ts time.Time) *types.Event {
+	h, ok := syslog.Parse(line, ts)
+	if !ok || h.Program != "systemd" {
+		return nil
+	}
+
+	event := parseMessage(h.Message)
+	if event == nil {
+		return nil
+	}
+	event.Timestamp = h.Timestamp
+	event.ServerID = p.serverID
+	event.RawLog = line
+	if h.PID > 1 {
+		// A user manager rather than PID 1.
+		event.SetMetadata("pid", h.PID)
+	}
+	return event
+}
+
+func parseMessage(msg string) *types.Event {
+	switch {
+	case strings.HasPrefix(msg, "Started "):
+		return lifecycle(types.EventServiceStarted, types.SeverityInfo, "Started", strings.TrimPrefix(msg, "Started "))
+	case strings.HasPrefix(msg, "Stopped "):
+		return lifecycle(types.EventServiceStopped, types.SeverityInfo, "Stopped", strings.TrimPrefix(msg, "Stopped "))
+	case strings.HasPrefix(msg, "Failed to start "):
+		return lifecycle(types.EventServiceFailed, types.SeverityError, "Failed to start", strings.TrimPrefix(msg, "Failed to start "))
+	}
+
+	if m := legacyFailPattern.FindStringSubmatch(msg); m != nil {
+		return newEvent(types.EventServiceFailed, types.SeverityError, m[1], m[1]+" failed")
+	}
+
+	m := unitMsgPattern.FindStringSubmatch(msg)
+	if m == nil {
+		return nil
+	}
+	unit, body := m[1], m[2]
+	if strings.HasSuffix(unit, ".scope") {
+		return nil
+	}
+
+	if m := exitPattern.FindStringSubmatch(body); m != nil {
+		code, status := m[1], m[2]
+		severity := types.SeverityError
+		if code == "exited" && strings.HasPrefix(status, "0/") {
+			severity = types.SeverityInfo
+		}
+		e := newEvent(types.EventServiceExited, severity, unit, unit+" main process exited, code="+code+", status="+status)
+		e.SetMetadata("exit_code", code)
+		e.SetMetadata("exit_status", status)
+		return e
+	}
+	if m := resultPattern.FindStringSubmatch(body); m != nil {
+		e := newEvent(types.EventServiceFailed, types.SeverityError, unit, unit+" failed: "+m[1])
+		e.SetMetadata("result", m[1])
+		return e
+	}
+	if m := restartPattern.FindStringSubmatch(body); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		e := newEvent(types.EventServiceRestarting, types.SeverityWarning, unit, unit+" restarting ("+m[1]+")")
+		e.SetMetadata("restart_count", n)
+		return e
+	}
+	if strings.HasPrefix(body, "Start request repeated too quickly") {
+		return newEvent(types.EventServiceRestartLimit, types.SeverityCritical, unit, unit+" hit its restart limit")
+	}
+	return nil
+}
+
+// lifecycle builds a Started, Stopped or "Failed to start" event from what
+// follows the verb: "unit - description" or only the description.
+func lifecycle(eventType types.EventType, severity types.Severity, verb, rest string) *types.Event {
+	if m := unitDescPattern.FindStringSubmatch(rest); m != nil {
+		e := newEvent(eventType, severity, m[1], verb+" "+m[1])
+		e.SetMetadata("description", m[2])
+		return e
+	}
+
+	desc := strings.TrimSuffix(rest, ".")
+	if desc == "" || sessionPattern.MatchString(desc) || strings.HasSuffix(desc, ".slice") || strings.HasSuffix(desc, ".scope") {
+		return nil
+	}
+	e := newEvent(eventType, severity, "", verb+" "+desc)
+	e.SetMetadata("description", desc)
+	return e
+}
+
+func newEvent(eventType types.EventType, severity types.Severity, unit, message string) *types.Event {
+	e := &types.Event{
+		EventType: eventType,
+		Severity:  severity,
+		Message:   message,
+	}
+	if unit != "" {
+		e.SetMetadata("unit", unit)
+	}
+	return e
+}
+
+// Unit returns the unit an event is about, or its description when the
+// log did not name the unit.
+func Unit(e *types.Event) string {
+	if u, ok := e.GetMetadata("unit").(string); ok && u != "" {
+		return u
+	}
+	if d, ok := e.GetMetadata("description").(string); ok {
+		return d
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+package timestamp
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// location is applied to timestamps that carry no zone of their own, such
+// as classic syslog or the nginx error log.
+var location = time.Local
+
+func SetLocation(loc *time.Location) {
+	if loc != nil {
+		location = loc
+	}
+}
+
+func Location() *time.Location {
+	return location
+}
+
+// LoadLocation resolves a configured timezone name. An empty name or
+// "Local" means the system zone.
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" || strings.EqualFold(name, "local") {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// Syslog parses an RFC 3164 timestamp ("Oct 11 22:14:15"). The year is
+// not logged, so it is taken from ref and moved back one year when that
+// would put the entry more than a week into the future, as happens when
+// December lines are read in January.
+func Syslog(s string, ref time.Time) (time.Time, bool) {
+	t, err := time.ParseInLocation(time.Stamp, strings.Join(strings.Fields(s), " "), location)
+	if err != nil {
+		t, err = time.ParseInLocation("Jan 2 15:04:05", strings.Join(strings.Fields(s), " "), location)
+		if err != nil {
+			return time.Time{}, false
+		}
+	}
+	ref = ref.In(location)
+	t = time.Date(ref.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, location)
+	if t.After(ref.Add(7 * 24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, true
+}
+
+// RFC3339 parses high-precision syslog timestamps as written by rsyslog's
+// RSYSLOG_FileFormat and journald exports.
+func RFC3339(s string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// CLF parses the common log format time used by nginx and Apache access
+// logs, e.g. "10/Oct/2000:13:55:36 -0700".
+func CLF(s string) (time.Time, bool) {
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// NginxError parses the error log time, e.g. "2024/01/02 15:04:05".
+func NginxError(s string) (time.Time, bool) {
+	t, err := time.ParseInLocation("2006/01/02 15:04:05", s, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// ApacheError parses the error log time with or without microseconds,
+// e.g. "Wed Oct 11 14:32:52.123456 2000".
+func ApacheError(s string) (time.Time, bool) {
+	s = strings.Join(strings.Fields(s), " ")
+	for _, layout := range []string{"Mon Jan 2 15:04:05.000000 2006", "Mon Jan 2 15:04:05 2006"} {
+		if t, err := time.ParseInLocation(layout, s, location); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+var pm2PrefixPattern = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?: ?(?:Z|[+-]\d{2}:?\d{2}))?):?\s+`)
+
+var pm2Layouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999-0700",
+	"2006-01-02 15:04:05.999999999 Z07:00",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05.999999999Z07:00",
+}
+
+var pm2LocalLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// PM2Prefix parses the timestamp PM2 prepends when started with --time or
+// a log_date_format, e.g. "2024-01-02T15:04:05: " or
+// "2024-01-02 15:04:05 +00:00: ". It returns the rest of the line.
+func PM2Prefix(line string) (time.Time, string, bool) {
+	m := pm2PrefixPattern.FindStringSubmatch(line)
+	if m == nil {
+		return time.Time{}, line, false
+	}
+	rest := line[len(m[0]):]
+	for _, layout := range pm2Layouts {
+		if t, err := time.Parse(layout, m[1]); err == nil {
+			return t, rest, true
+		}
+	}
+	for _, layout := range pm2LocalLayouts {
+		if t, err := time.ParseInLocation(layout, m[1], location); err == nil {
+			return t, rest, true
+		}
+	}
+	return time.Time{}, line, false
+}
+
+// Format parses s according to a format named in the config: one of
+// "rfc3339", "clf", "syslog", "unix", "unix_ms", or otherwise a Go time
+// layout, read in the configured zone when it has no offset. An empty
+// format tries RFC 3339, CLF and syslog in turn.
+func Format(s, format string, ref time.Time) (time.Time, bool) {
+	switch format {
+	case "":
+		if t, ok := RFC3339(s); ok {
+			return t, true
+		}
+		if t, ok := CLF(s); ok {
+			return t, true
+		}
+		return Syslog(s, ref)
+	case "rfc3339", "iso8601":
+		return RFC3339(s)
+	case "clf":
+		return CLF(s)
+	case "syslog":
+		return Syslog(s, ref)
+	case "unix", "unix_ms":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if format == "unix_ms" {
+			return time.UnixMilli(int64(f)), true
+		}
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+	}
+	t, err := time.ParseInLocation(format, s, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
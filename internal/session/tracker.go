@@ -0,0 +1,144 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/SdxShadow/Mlog/internal/db"
+	"github.com/SdxShadow/Mlog/pkg/types"
+)
+
+// Tracker turns SSH login and logout events into rows of ssh_sessions.
+//
+// A login is logged by the sshd process that handles the connection, and
+// the same PID later logs "pam_unix(sshd:session): session closed". The
+// "Disconnected from user" line comes from a child process instead, so it
+// is matched on source address and port.
+type Tracker struct {
+	active map[int]*types.SSHSession
+}
+
+// NewTracker loads the sessions left open by a previous run. They stay
+// open while the log catch-up may still close them and are reconciled
+// once it is done.
+func NewTracker() *Tracker {
+	t := &Tracker{active: make(map[int]*types.SSHSession)}
+
+	sessions, err := db.ActiveSessions()
+	if err != nil {
+		log.Printf("Failed to load active sessions: %v", err)
+	}
+	for _, s := range sessions {
+		if pid := sessionPID(s.SessionID); pid > 0 {
+			t.active[pid] = s
+		}
+	}
+	return t
+}
+
+func (t *Tracker) Observe(e *types.Event) []*types.Event {
+	switch e.EventType {
+	case types.EventSSHConnected:
+		t.open(e)
+	case types.EventSSHDisconnected:
+		t.close(e)
+	}
+	return nil
+}
+
+func (t *Tracker) open(e *types.Event) {
+	pid, _ := e.GetMetadata("pid").(int)
+	if pid <= 0 {
+		return
+	}
+
+	s := &types.SSHSession{
+		SessionID:   fmt.Sprintf("%d-%d", pid, e.Timestamp.Unix()),
+		Username:    e.Username,
+		SourceIP:    e.SourceIP,
+		SourcePort:  e.SourcePort,
+		ConnectedAt: e.Timestamp,
+		Status:      types.SessionActive,
+	}
+	s.AuthMethod, _ = e.GetMetadata("auth_method").(string)
+
+	if err := db.InsertSession(s); err != nil {
+		// Replaying a line already seen yields the same session id.
+		if !strings.Contains(err.Error(), "UNIQUE") {
+			log.Printf("Failed to record SSH session: %v", err)
+		}
+		return
+	}
+	t.active[pid] = s
+}
+
+func (t *Tracker) close(e *types.Event) {
+	pid, s := t.find(e)
+	if s == nil {
+		return
+	}
+
+	s.DisconnectedAt = e.Timestamp
+	s.Duration = int64(e.Timestamp.Sub(s.ConnectedAt).Seconds())
+	if s.Duration < 0 {
+		s.Duration = 0
+	}
+	s.Status = types.SessionClosed
+	if err := db.UpdateSession(s); err != nil {
+		log.Printf("Failed to close SSH session %s: %v", s.SessionID, err)
+		return
+	}
+	delete(t.active, pid)
+}
+
+func (t *Tracker) find(e *types.Event) (int, *types.SSHSession) {
+	if pid, ok := e.GetMetadata("pid").(int); ok {
+		if s, ok := t.active[pid]; ok {
+			return pid, s
+		}
+	}
+	if e.SourceIP == "" || e.SourcePort == 0 {
+		return 0, nil
+	}
+	for pid, s := range t.active {
+		if s.SourceIP == e.SourceIP && s.SourcePort == e.SourcePort {
+			return pid, s
+		}
+	}
+	return 0, nil
+}
+
+// CaughtUp reconciles the sessions inherited from the previous run once
+// the log catch-up has been stored. Sessions whose sshd process is still
+// alive are kept; the rest ended while mlog was down without a trace in
+// the logs.
+func (t *Tracker) CaughtUp() []*types.Event {
+	for pid, s := range t.active {
+		if sshdAlive(pid) {
+			continue
+		}
+		s.Status = types.SessionLost
+		if err := db.UpdateSession(s); err != nil {
+			log.Printf("Failed to reconcile SSH session %s: %v", s.SessionID, err)
+			continue
+		}
+		delete(t.active, pid)
+	}
+	return nil
+}
+
+func sessionPID(id string) int {
+	pid, _ := strconv.Atoi(strings.SplitN(id, "-", 2)[0])
+	return pid
+}
+
+func sshdAlive(pid int) bool {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(string(comm)), "sshd")
+}
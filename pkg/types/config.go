@@ -15,6 +15,7 @@ type ServerConfig struct {
 	ID               string `yaml:"id"`
 	Hostname         string `yaml:"hostname"`
 	PollingInterval  string `yaml:"polling_interval"`
+	Timezone         string `yaml:"timezone"`
 }
 
 type LoggingConfig struct {
@@ -23,9 +24,10 @@ type LoggingConfig struct {
 }
 
 type DatabaseConfig struct {
-	Path          string `yaml:"path"`
-	MaxSizeMB     int    `yaml:"max_size_mb"`
-	RetentionDays int    `yaml:"retention_days"`
+	Path                string `yaml:"path"`
+	MaxSizeMB           int    `yaml:"max_size_mb"`
+	RetentionDays       int    `yaml:"retention_days"`
+	MaintenanceInterval string `yaml:"maintenance_interval"`
 }
 
 type SSHConfig struct {
@@ -43,17 +45,34 @@ type SecurityConfig struct {
 type BruteForceConfig struct {
 	Threshold      int `yaml:"threshold"`
 	WindowMinutes int `yaml:"window_minutes"`
+	QuietMinutes  int `yaml:"quiet_minutes"`
 }
 
 type PortScanConfig struct {
-	Threshold     int `yaml:"threshold"`
-	WindowSeconds int `yaml:"window_seconds"`
+	Threshold     int      `yaml:"threshold"`
+	WindowSeconds int      `yaml:"window_seconds"`
+	QuietSeconds  int      `yaml:"quiet_seconds"`
+	LogFiles      []string `yaml:"log_files"`
 }
 
 type SystemConfig struct {
-	Enabled    bool     `yaml:"enabled"`
-	LogFiles   []string `yaml:"log_files"`
-	Journalctl bool     `yaml:"journalctl"`
+	Enabled        bool                  `yaml:"enabled"`
+	LogFiles       []string              `yaml:"log_files"`
+	KernelLogFiles []string              `yaml:"kernel_log_files"`
+	Kmsg           bool                  `yaml:"kmsg"`
+	KmsgPath       string                `yaml:"kmsg_path"`
+	AuditLog       string                `yaml:"audit_log"`
+	Journalctl     bool                  `yaml:"journalctl"`
+	JournalctlPath string                `yaml:"journalctl_path"`
+	JournalParsers []JournalParserConfig `yaml:"journal_parsers"`
+}
+
+// JournalParserConfig names the parser for the journal entries of a
+// SYSLOG_IDENTIFIER, or of a systemd unit such as "myapp.service". It is a
+// list rather than a map because unit names contain dots.
+type JournalParserConfig struct {
+	Match  string `yaml:"match"`
+	Parser string `yaml:"parser"`
 }
 
 type ApplicationConfig struct {
@@ -62,12 +81,19 @@ type ApplicationConfig struct {
 	Apache  ApacheConfig        `yaml:"apache"`
 	PM2     PM2Config           `yaml:"pm2"`
 	Custom  []CustomLogConfig  `yaml:"custom"`
+	// JSONAccess lists access logs written as JSON lines.
+	JSONAccess []JSONAccessConfig `yaml:"json_access"`
+	Latency    LatencyConfig      `yaml:"latency"`
+	// GrokPatterns lists pattern files, or directories of them, available
+	// to the grok expressions of custom logs.
+	GrokPatterns []string `yaml:"grok_patterns"`
 }
 
 type NginxConfig struct {
 	Enabled      bool   `yaml:"enabled"`
 	AccessLog    string `yaml:"access_log"`
 	ErrorLog     string `yaml:"error_log"`
+	LogFormat    string `yaml:"log_format"`
 	WatchVhosts  bool   `yaml:"watch_vhosts"`
 }
 
@@ -77,22 +103,78 @@ type ApacheConfig struct {
 	ErrorLog      string `yaml:"error_log"`
 	RHELAccessLog string `yaml:"rhel_access_log"`
 	RHELErrorLog  string `yaml:"rhel_error_log"`
+	LogFormat     string `yaml:"log_format"`
 }
 
 type PM2Config struct {
-	Enabled     bool   `yaml:"enabled"`
-	LogDir      string `yaml:"log_dir"`
-	WatchStdout bool   `yaml:"watch_stdout"`
-	WatchStderr bool   `yaml:"watch_stderr"`
+	Enabled     bool            `yaml:"enabled"`
+	LogDir      string          `yaml:"log_dir"`
+	WatchStdout bool            `yaml:"watch_stdout"`
+	WatchStderr bool            `yaml:"watch_stderr"`
+	Multiline   MultilineConfig `yaml:"multiline"`
+}
+
+// MultilineConfig joins lines into one entry, e.g. the frames of a stack
+// trace. Lines matching Continuation, or not matching Start, belong to the
+// entry before them.
+type MultilineConfig struct {
+	Start        string `yaml:"start"`
+	Continuation string `yaml:"continuation"`
+	MaxLines     int    `yaml:"max_lines"`
+	Timeout      string `yaml:"timeout"`
 }
 
 type CustomLogConfig struct {
-	Name    string `yaml:"name"`
-	Enabled bool   `yaml:"enabled"`
-	Path    string `yaml:"path"`
+	Name       string             `yaml:"name"`
+	Enabled    bool               `yaml:"enabled"`
+	Path       string             `yaml:"path"`
+	Parser     string             `yaml:"parser"`
+	Pattern    string             `yaml:"pattern"`
+	Grok       string             `yaml:"grok"`
+	TimeFormat string             `yaml:"time_format"`
+	Fields     map[string]string  `yaml:"fields"`
+	EventType  string             `yaml:"event_type"`
+	Severity   string             `yaml:"severity"`
+	Rules      []CustomRuleConfig `yaml:"rules"`
+	Multiline  MultilineConfig    `yaml:"multiline"`
+}
+
+// LatencyConfig controls the per-route response time histograms kept from
+// the request_time of access logs. MaxRoutes caps the routes counted per
+// minute; requests for any others are counted together.
+type LatencyConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	MaxRoutes int  `yaml:"max_routes"`
+}
+
+// JSONAccessConfig is an access log written as JSON lines. Preset names a
+// built-in layout: nginx, caddy or traefik. Fields maps access log
+// variables, named as in nginx (remote_addr, status, request_time, ...), to
+// the dotted paths of the JSON values holding them, e.g.
+// http_user_agent: request.headers.User-Agent.
+type JSONAccessConfig struct {
+	Name      string            `yaml:"name"`
+	Enabled   bool              `yaml:"enabled"`
+	Path      string            `yaml:"path"`
+	Preset    string            `yaml:"preset"`
+	Fields    map[string]string `yaml:"fields"`
+	EventType string            `yaml:"event_type"`
+}
+
+// CustomRuleConfig overrides the severity or event type of a custom log
+// event when a field matches. Field names a capture group or an event
+// field such as message.
+type CustomRuleConfig struct {
+	Field     string `yaml:"field"`
+	Match     string `yaml:"match"`
+	Severity  string `yaml:"severity"`
+	EventType string `yaml:"event_type"`
 }
 
 type MonitoringConfig struct {
-	Realtime   bool `yaml:"realtime"`
-	BufferSize int  `yaml:"buffer_size"`
+	Realtime      bool   `yaml:"realtime"`
+	BufferSize    int    `yaml:"buffer_size"`
+	BatchSize     int    `yaml:"batch_size"`
+	FlushInterval string `yaml:"flush_interval"`
+	Overflow      string `yaml:"overflow"`
 }
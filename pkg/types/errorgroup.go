@@ -0,0 +1,17 @@
+package types
+
+import "time"
+
+// ErrorGroup is a recurring error: the error events whose messages are
+// the same once their variable parts are normalised away. Signature is the
+// normalised message and Sample the latest occurrence as logged.
+type ErrorGroup struct {
+	Fingerprint string    `json:"fingerprint"`
+	EventType   EventType `json:"event_type"`
+	Source      string    `json:"source,omitempty"`
+	Signature   string    `json:"signature"`
+	Sample      string    `json:"sample"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Count       int64     `json:"count"`
+}
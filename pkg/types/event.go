@@ -18,8 +18,45 @@ const (
 	EventSudoSuccess        EventType = "SUDO_SUCCESS"
 	EventSudoFailed         EventType = "SUDO_FAILED"
 
-	EventServiceStarted EventType = "SERVICE_STARTED"
-	EventServiceStopped EventType = "SERVICE_STOPPED"
+	EventSuSuccess       EventType = "SU_SUCCESS"
+	EventSuFailed        EventType = "SU_FAILED"
+	EventSuSessionOpened EventType = "SU_SESSION_OPENED"
+	EventSuSessionClosed EventType = "SU_SESSION_CLOSED"
+
+	EventAccountUserAdded          EventType = "ACCOUNT_USER_ADDED"
+	EventAccountUserDeleted        EventType = "ACCOUNT_USER_DELETED"
+	EventAccountUserModified       EventType = "ACCOUNT_USER_MODIFIED"
+	EventAccountPasswordChanged    EventType = "ACCOUNT_PASSWORD_CHANGED"
+	EventAccountExpiryChanged      EventType = "ACCOUNT_EXPIRY_CHANGED"
+	EventAccountGroupAdded         EventType = "ACCOUNT_GROUP_ADDED"
+	EventAccountGroupDeleted       EventType = "ACCOUNT_GROUP_DELETED"
+	EventAccountGroupModified      EventType = "ACCOUNT_GROUP_MODIFIED"
+	EventAccountGroupMemberAdded   EventType = "ACCOUNT_GROUP_MEMBER_ADDED"
+	EventAccountGroupMemberRemoved EventType = "ACCOUNT_GROUP_MEMBER_REMOVED"
+
+	EventFirewallBlock EventType = "FIREWALL_BLOCK"
+	EventFirewallAllow EventType = "FIREWALL_ALLOW"
+	EventFirewallLog   EventType = "FIREWALL_LOG"
+
+	EventKernelOOMKill  EventType = "KERNEL_OOM_KILL"
+	EventKernelSegfault EventType = "KERNEL_SEGFAULT"
+	EventKernelHungTask EventType = "KERNEL_HUNG_TASK"
+	EventKernelFSError  EventType = "KERNEL_FS_ERROR"
+	EventKernelIOError  EventType = "KERNEL_IO_ERROR"
+
+	EventAuditUserLogin    EventType = "AUDIT_USER_LOGIN"
+	EventAuditUserAuth     EventType = "AUDIT_USER_AUTH"
+	EventAuditUserCmd      EventType = "AUDIT_USER_CMD"
+	EventAuditExecve       EventType = "AUDIT_EXECVE"
+	EventAuditSyscall      EventType = "AUDIT_SYSCALL"
+	EventAuditConfigChange EventType = "AUDIT_CONFIG_CHANGE"
+
+	EventServiceStarted      EventType = "SERVICE_STARTED"
+	EventServiceStopped      EventType = "SERVICE_STOPPED"
+	EventServiceFailed       EventType = "SERVICE_FAILED"
+	EventServiceExited       EventType = "SERVICE_EXITED"
+	EventServiceRestarting   EventType = "SERVICE_RESTARTING"
+	EventServiceRestartLimit EventType = "SERVICE_RESTART_LIMIT"
 
 	EventNginxRequest EventType = "NGINX_REQUEST"
 	EventNginxError   EventType = "NGINX_ERROR"
@@ -27,6 +64,9 @@ const (
 	EventApacheRequest EventType = "APACHE_REQUEST"
 	EventApacheError   EventType = "APACHE_ERROR"
 
+	EventCaddyRequest   EventType = "CADDY_REQUEST"
+	EventTraefikRequest EventType = "TRAEFIK_REQUEST"
+
 	EventPM2Start    EventType = "PM2_START"
 	EventPM2Stop     EventType = "PM2_STOP"
 	EventPM2Restart  EventType = "PM2_RESTART"
@@ -34,9 +74,16 @@ const (
 	EventPM2Crash    EventType = "PM2_CRASH"
 	EventPM2Exit     EventType = "PM2_EXIT"
 
+	EventErrorGroupNew EventType = "ERROR_GROUP_NEW"
+
 	EventCustom EventType = "CUSTOM"
 )
 
+// HTTPRequestEvents are the access log events. They share their metadata
+// keys (method, uri, status, bytes, request_time, host, ...) whatever the
+// server that logged them.
+var HTTPRequestEvents = []EventType{EventNginxRequest, EventApacheRequest, EventCaddyRequest, EventTraefikRequest}
+
 type Severity string
 
 const (
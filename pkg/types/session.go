@@ -1,10 +1,19 @@
 package types
 
 import (
+	"encoding/json"
 	"net"
 	"time"
 )
 
+const (
+	SessionActive = "active"
+	SessionClosed = "closed"
+	// SessionLost marks a session whose sshd process was gone when mlog
+	// restarted and whose end was never logged.
+	SessionLost = "lost"
+)
+
 type SSHSession struct {
 	ID            int64     `json:"id"`
 	SessionID     string    `json:"session_id"`
@@ -23,6 +32,11 @@ func (s *SSHSession) SourceIPNet() net.IP {
 	return net.ParseIP(s.SourceIP)
 }
 
+const (
+	IncidentBruteForce = "brute_force"
+	IncidentPortScan   = "port_scan"
+)
+
 type SecurityIncident struct {
 	ID           int64     `json:"id"`
 	IncidentType string    `json:"incident_type"`
@@ -42,3 +56,11 @@ func (i *SecurityIncident) SetMetadata(key string, value interface{}) {
 	}
 	i.Metadata[key] = value
 }
+
+func (i *SecurityIncident) MetadataJSON() string {
+	if i.Metadata == nil {
+		return "{}"
+	}
+	b, _ := json.Marshal(i.Metadata)
+	return string(b)
+}